@@ -11,6 +11,7 @@ import (
 
 	"github.com/go-portfolio/http-middleware/internal/handlers"
 	"github.com/go-portfolio/http-middleware/internal/middleware/auth"
+	"github.com/go-portfolio/http-middleware/internal/middleware/csrf"
 	"github.com/go-portfolio/http-middleware/internal/middleware/distributedlock"
 	"github.com/go-portfolio/http-middleware/internal/middleware/logging"
 	"github.com/go-portfolio/http-middleware/internal/middleware/metrics"
@@ -87,8 +88,16 @@ func pageHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func processHandler(w http.ResponseWriter, r *http.Request) {
-	item := w.Header().Get("X-Queue-Item")
-	utils.JSON(w, http.StatusOK, map[string]string{"status": "processed", "task": item})
+	item, ok := queue.ItemFromContext(r.Context())
+	if !ok {
+		utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "queue unavailable"})
+		return
+	}
+	utils.JSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "processed",
+		"task":    item.ID,
+		"attempt": item.Attempt,
+	})
 }
 
 func SecureHandler(w http.ResponseWriter, r *http.Request) {
@@ -99,6 +108,20 @@ func UpdateHandler(w http.ResponseWriter, r *http.Request) {
 	utils.JSON(w, http.StatusOK, map[string]string{"status": "update applied"})
 }
 
+// ResourceHandler отдаёт версионируемый ресурс (ETag выставляет VersionedMiddleware).
+func ResourceHandler(w http.ResponseWriter, r *http.Request) {
+	res, ok := stateupdate.ResourceFromContext(r.Context())
+	if !ok {
+		utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "state store unavailable"})
+		return
+	}
+	if res.Version == 0 && r.Method != http.MethodDelete {
+		utils.JSON(w, http.StatusNotFound, map[string]string{"error": "resource not found"})
+		return
+	}
+	utils.JSON(w, http.StatusOK, map[string]interface{}{"value": res.Value, "version": res.Version})
+}
+
 func main() {
 	tp, metricsHandler, err := initProvider()
 	if err != nil {
@@ -115,6 +138,56 @@ func main() {
 		log.Fatalf("Redis init error: %v", err)
 	}
 
+	// Бэкенд сессий выбирается через SESSION_BACKEND: redis (по умолчанию) или cookie
+	var sessionStore session.Store
+	if os.Getenv("SESSION_BACKEND") == "cookie" {
+		keys, err := session.ParseKeys(os.Getenv("SESSION_KEYS"))
+		if err != nil {
+			log.Fatalf("session keys error: %v", err)
+		}
+		if sessionStore, err = session.NewCookieStore(10, keys...); err != nil {
+			log.Fatalf("session store error: %v", err)
+		}
+	} else {
+		if err := session.InitRedisSession("localhost:6379", "", 0); err != nil {
+			log.Fatalf("Redis session init error: %v", err)
+		}
+		sessionStore = session.NewRedisStore(10)
+	}
+
+	if err := distributedlock.InitRedisLock("localhost:6379", "", 0); err != nil {
+		log.Fatalf("Redis lock init error: %v", err)
+	}
+
+	if err := queue.InitRedisQueue("localhost:6379", "", 0); err != nil {
+		log.Fatalf("Redis queue init error: %v", err)
+	}
+	// Задачи, зависшие в работе дольше VisibilityTimeout, возвращаются в очередь;
+	// после пяти неудачных доставок — уходят в DLQ (queue:tasks:dead)
+	queueOpts := queue.Options{SourceKey: "queue:tasks", ProcessingKey: "queue:inprogress", MaxDeliveries: 5, WaitTimeout: 20 * time.Second}
+	queue.StartReaper(context.Background(), queueOpts, 10*time.Second)
+	producer := queue.NewProducer(queueOpts.SourceKey)
+	producer.StartScheduler(context.Background(), time.Second)
+
+	if err := pagecounter.InitRedisCounter("localhost:6379", "", 0); err != nil {
+		log.Fatalf("Redis counter init error: %v", err)
+	}
+	// Просмотры страниц в разрезе маршрута, метода и источника перехода
+	pageViews := pagecounter.Options{
+		Prefix:     "counter:page_view",
+		Dimensions: []pagecounter.Dimension{pagecounter.DimRoute, pagecounter.DimMethod, pagecounter.DimReferrer},
+		// Уникальные посетители за сутки и неделю (page_unique_visitors_daily/weekly)
+		UniqueVisitors: true,
+		// Временной ряд: минутные бакеты сворачиваются в часовые и дневные раз в минуту
+		TimeSeries: true,
+	}
+	pagecounter.StartRollup(context.Background(), pageViews, time.Minute)
+	pagecounter.StartMaterializeWeeks(context.Background(), pageViews, time.Hour)
+
+	if err := stateupdate.InitRedisState("localhost:6379", "", 0); err != nil {
+		log.Fatalf("Redis state init error: %v", err)
+	}
+
 	mux := http.NewServeMux()
 
 	// --- /metrics через OpenTelemetry + Prometheus
@@ -141,31 +214,136 @@ func main() {
 		auth.Auth,
 		slidingwindow.SlidingWindow(limit, windowMS)))
 
-	mux.Handle("/order", Chain(http.HandlerFunc(orderHandler),
+	// Блокировка берётся на конкретный заказ, а не на все заказы сразу.
+	// ID заказа — из пути (/order/42) или из query (/order?orderId=42).
+	orderLock := distributedlock.RedisLockMiddlewareWithOptions(distributedlock.Options{
+		KeyFunc: distributedlock.MustKeyTemplate("lock:order:{orderId}"),
+		TTLMS:   5000,
+	})
+	for _, pattern := range []string{"/order", "/order/{orderId}"} {
+		mux.Handle(pattern, Chain(http.HandlerFunc(orderHandler),
+			recovery.Recovery,
+			logging.Logging,
+			metrics.Metrics,
+			auth.Auth,
+			orderLock))
+	}
+
+	mux.Handle("/page", Chain(http.HandlerFunc(pageHandler),
+		recovery.Recovery,
+		logging.Logging,
+		metrics.Metrics,
+		pagecounter.CounterMiddlewareWithOptions(pageViews)))
+
+	mux.Handle("/admin/pageviews", Chain(pagecounter.CountsHandler(pageViews),
 		recovery.Recovery,
 		logging.Logging,
 		metrics.Metrics,
-		auth.Auth,
-		distributedlock.RedisLockMiddleware("lock:order:123", 5000)))
+		auth.Auth))
 
-	mux.Handle("/page", Chain(http.HandlerFunc(pageHandler),
+	mux.Handle("/admin/pageviews/uniques", Chain(pagecounter.UniquesHandler(pageViews),
+		recovery.Recovery,
+		logging.Logging,
+		metrics.Metrics,
+		auth.Auth))
+
+	mux.Handle("/admin/pageviews/series", Chain(pagecounter.SeriesHandler(pageViews),
 		recovery.Recovery,
 		logging.Logging,
 		metrics.Metrics,
-		pagecounter.CounterMiddleware("counter:page_view", 60)))
+		auth.Auth))
 
 	mux.Handle("/process", Chain(http.HandlerFunc(processHandler),
 		recovery.Recovery,
 		logging.Logging,
 		metrics.Metrics,
-		queue.QueueMiddleware("queue:tasks", "queue:inprogress")))
+		queue.QueueMiddlewareWithOptions(queueOpts)))
+
+	mux.Handle("/enqueue", Chain(queue.EnqueueHandler(producer),
+		recovery.Recovery,
+		logging.Logging,
+		metrics.Metrics,
+		auth.Auth))
+
+	mux.Handle("/admin/queue/dlq", Chain(queue.DeadLetterHandler(queueOpts),
+		recovery.Recovery,
+		logging.Logging,
+		metrics.Metrics,
+		auth.Auth))
 
 	mux.Handle("/secure2", Chain(http.HandlerFunc(SecureHandler),
-		session.SessionMiddleware(10)))
+		session.SessionMiddlewareWithStore(sessionStore),
+		csrf.CSRFMiddleware(csrf.Options{Mode: csrf.SessionMode})))
 
 	mux.Handle("/update", Chain(http.HandlerFunc(UpdateHandler),
 		stateupdate.StateUpdateMiddleware("state:item123", "old", "new")))
 
+	// Произвольное состояние элемента из запроса: {"expected": "...", "value": "..."}.
+	// Свой префикс ключей: заказы меняются только через машину состояний ниже.
+	mux.Handle("POST /items/{id}/state", Chain(http.HandlerFunc(UpdateHandler),
+		recovery.Recovery,
+		logging.Logging,
+		metrics.Metrics,
+		auth.Auth,
+		stateupdate.StateUpdateMiddlewareWithOptions(stateupdate.Options{
+			KeyPrefix: "state:item:",
+			Key:       stateupdate.PathValue("id"),
+			Expected:  stateupdate.JSONField("expected"),
+			Value:     stateupdate.JSONField("value"),
+		})))
+
+	// Жизненный цикл заказа: created -> paid -> shipped -> delivered, из любого — cancelled
+	orderMachine, err := stateupdate.NewMachine(stateupdate.MachineDefinition{
+		Initial: "created",
+		States:  []string{"created", "paid", "shipped", "delivered", "cancelled"},
+		Transitions: []stateupdate.TransitionRule{
+			{From: stateupdate.StateList{"created"}, To: "paid"},
+			{From: stateupdate.StateList{"paid"}, To: "shipped"},
+			{From: stateupdate.StateList{"shipped"}, To: "delivered"},
+			{From: stateupdate.StateList{stateupdate.AnyState}, To: "cancelled"},
+		},
+	})
+	if err != nil {
+		log.Fatalf("order state machine error: %v", err)
+	}
+	orderMachine.OnTransition(func(ctx context.Context, e stateupdate.TransitionEvent) {
+		log.Printf("order %s: %q -> %q", e.Key, e.From, e.To)
+	})
+	// Журнал переходов заказа: последние 1000 записей, не старше 90 дней.
+	// Сессии на маршруте нет: заказы меняет владелец AUTH_TOKEN, он и записывается в журнал.
+	orderOpts := stateupdate.Options{
+		KeyPrefix: "state:order:",
+		Key:       stateupdate.PathValue("id"),
+		Value:     stateupdate.JSONField("state"),
+		History: stateupdate.HistoryOptions{
+			Enabled: true,
+			MaxLen:  1000,
+			MaxAge:  90 * 24 * time.Hour,
+			Principal: func(r *http.Request) string {
+				return auth.PrincipalFromContext(r.Context())
+			},
+		},
+	}
+	mux.Handle("POST /orders/{id}/transition", Chain(http.HandlerFunc(UpdateHandler),
+		recovery.Recovery,
+		logging.Logging,
+		metrics.Metrics,
+		auth.Auth,
+		stateupdate.StateMachineMiddleware(orderMachine, orderOpts)))
+	mux.Handle("GET /orders/{id}/history", Chain(stateupdate.HistoryHandler(orderOpts),
+		recovery.Recovery,
+		logging.Logging,
+		metrics.Metrics,
+		auth.Auth))
+
+	// Версионируемые ресурсы: GET отдаёт ETag, запись требует If-Match
+	mux.Handle("/resources/", Chain(http.HandlerFunc(ResourceHandler),
+		recovery.Recovery,
+		logging.Logging,
+		metrics.Metrics,
+		auth.Auth,
+		stateupdate.VersionedMiddleware(stateupdate.VersionedOptions{KeyPrefix: "state"})))
+
 	log.Printf("listening on %s", addr)
 	log.Fatal(http.ListenAndServe(addr, mux))
 
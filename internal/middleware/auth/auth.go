@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"strings"
@@ -21,12 +22,31 @@ func init() {
 	authFailed, _ = meter.Int64Counter("auth_failed_total")
 }
 
+// defaultPrincipal — имя владельца AUTH_TOKEN, если AUTH_PRINCIPAL не задан.
+const defaultPrincipal = "api"
+
+type principalContextKey struct{}
+
+// PrincipalFromContext возвращает, кто прошёл проверку Auth в текущем запросе
+// (пусто — middleware не подключён). Годится для журналов аудита: в отличие от
+// заголовков запроса, его нельзя подставить без токена.
+func PrincipalFromContext(ctx context.Context) string {
+	p, _ := ctx.Value(principalContextKey{}).(string)
+	return p
+}
+
 // Auth — middleware для проверки авторизации по токену.
+// Владелец токена (AUTH_PRINCIPAL, по умолчанию defaultPrincipal) доступен
+// дальше по цепочке через PrincipalFromContext.
 // Метрики:
 // - auth_success_total — успешные авторизации
 // - auth_failed_total — неуспешные авторизации
 func Auth(next http.Handler) http.Handler {
 	token := os.Getenv("AUTH_TOKEN")
+	principal := os.Getenv("AUTH_PRINCIPAL")
+	if principal == "" {
+		principal = defaultPrincipal
+	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		auth := r.Header.Get("Authorization")
@@ -38,6 +58,6 @@ func Auth(next http.Handler) http.Handler {
 		}
 
 		authSuccess.Add(r.Context(), 1)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal)))
 	})
 }
@@ -14,7 +14,9 @@ func TestAuthMiddleware(t *testing.T) {
 
 	// Создаём базовый handler, который возвращает 200 OK,
 	// если его вызов прошёл через middleware.
+	var principal string
 	handler := Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = PrincipalFromContext(r.Context())
 		w.WriteHeader(http.StatusOK)
 	}))
 
@@ -48,4 +50,9 @@ func TestAuthMiddleware(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Fatalf("want 200, got %d", rr.Code)
 	}
+
+	// Handler знает, кто прошёл проверку, — владельца токена
+	if principal != defaultPrincipal {
+		t.Fatalf("want principal %q, got %q", defaultPrincipal, principal)
+	}
 }
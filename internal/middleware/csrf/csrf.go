@@ -0,0 +1,190 @@
+package csrf
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-portfolio/http-middleware/internal/middleware/session"
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// HeaderName — заголовок, в котором клиент передаёт токен.
+	HeaderName = "X-CSRF-Token"
+	// FieldName — поле формы с токеном; оно же ключ токена в сессии.
+	FieldName = "csrf_token"
+	// CookieName — cookie с токеном в режиме double-submit.
+	CookieName = "csrf_token"
+)
+
+// Mode — способ хранения эталонного токена.
+type Mode int
+
+const (
+	// SessionMode — synchronizer token: токен хранится в сессии,
+	// перед middleware должен стоять session.SessionMiddleware.
+	SessionMode Mode = iota
+	// DoubleSubmitMode — токен хранится в cookie и должен совпасть с заголовком или полем формы.
+	DoubleSubmitMode
+)
+
+// Options — настройки CSRF-защиты.
+type Options struct {
+	Mode Mode
+	// TrustedOrigins — дополнительные разрешённые Origin (например, https://admin.example.com)
+	// помимо хоста самого запроса.
+	TrustedOrigins []string
+	// Secure выставляет флаг Secure у cookie с токеном.
+	Secure bool
+}
+
+var (
+	meter         = otel.Meter("csrf")
+	passedCounter metric.Int64Counter
+	rejectCounter metric.Int64Counter
+)
+
+func init() {
+	passedCounter, _ = meter.Int64Counter("csrf_passed_total")
+	rejectCounter, _ = meter.Int64Counter("csrf_rejected_total")
+}
+
+type contextKey struct{}
+
+// Token возвращает CSRF-токен текущего запроса, чтобы handler мог
+// вставить его в форму или отдать клиенту.
+func Token(ctx context.Context) string {
+	token, _ := ctx.Value(contextKey{}).(string)
+	return token
+}
+
+// CSRFMiddleware защищает небезопасные методы (POST, PUT, PATCH, DELETE) от CSRF:
+// проверяет Origin и Sec-Fetch-Site, затем сравнивает токен из заголовка X-CSRF-Token
+// или поля формы csrf_token с эталонным. При ошибке возвращает 403.
+func CSRFMiddleware(opts Options) func(http.Handler) http.Handler {
+	trusted := make(map[string]bool, len(opts.TrustedOrigins))
+	for _, origin := range opts.TrustedOrigins {
+		trusted[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			expected := storedToken(r, opts.Mode)
+			token := expected
+			if token == "" {
+				// Выдаём токен для следующих запросов; текущий небезопасный запрос
+				// без сохранённого токена всё равно будет отклонён.
+				token = newToken()
+				if !saveToken(w, r, opts, token) {
+					token = ""
+				}
+			}
+			ctx := context.WithValue(r.Context(), contextKey{}, token)
+
+			if isSafeMethod(r.Method) {
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			if !sameOrigin(r, trusted) {
+				reject(w, r, "cross-origin request")
+				return
+			}
+
+			actual := r.Header.Get(HeaderName)
+			if actual == "" {
+				actual = r.PostFormValue(FieldName)
+			}
+			if expected == "" || actual == "" {
+				reject(w, r, "missing csrf token")
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+				reject(w, r, "invalid csrf token")
+				return
+			}
+
+			passedCounter.Add(r.Context(), 1)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func reject(w http.ResponseWriter, r *http.Request, msg string) {
+	rejectCounter.Add(r.Context(), 1)
+	utils.JSON(w, http.StatusForbidden, map[string]string{"error": msg})
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// sameOrigin отклоняет запросы, которые браузер пометил как межсайтовые,
+// и запросы с Origin, не совпадающим с хостом запроса или доверенным списком.
+// Клиенты без этих заголовков (curl, серверы) проходят дальше на проверку токена.
+func sameOrigin(r *http.Request, trusted map[string]bool) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if origin != "" {
+		if trusted[origin] {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" || !strings.EqualFold(u.Host, r.Host) {
+			return false
+		}
+	}
+
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" && !trusted[origin] {
+		return false
+	}
+	return true
+}
+
+func storedToken(r *http.Request, mode Mode) string {
+	if mode == DoubleSubmitMode {
+		if c, err := r.Cookie(CookieName); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	v, _ := session.Get(r.Context(), FieldName)
+	token, _ := v.(string)
+	return token
+}
+
+// saveToken сохраняет новый токен. Без сессии в контексте (SessionMode) токен не сохранить.
+func saveToken(w http.ResponseWriter, r *http.Request, opts Options, token string) bool {
+	if opts.Mode == DoubleSubmitMode {
+		// Cookie без HttpOnly: скрипт страницы читает её и повторяет в заголовке
+		http.SetCookie(w, &http.Cookie{
+			Name:     CookieName,
+			Value:    token,
+			Path:     "/",
+			Secure:   opts.Secure,
+			SameSite: http.SameSiteStrictMode,
+		})
+		return true
+	}
+	if session.FromContext(r.Context()) == nil {
+		return false
+	}
+	session.Set(r.Context(), FieldName, token)
+	return true
+}
+
+func newToken() string {
+	buf := make([]byte, 32)
+	_, _ = rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,104 @@
+package csrf
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-portfolio/http-middleware/internal/middleware/session"
+	"github.com/go-portfolio/http-middleware/internal/utils"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	// Используем cookie-бэкенд сессий, чтобы тест не зависел от Redis
+	store, err := session.NewCookieStore(60, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("failed to create session store: %v", err)
+	}
+
+	var token string
+	handler := session.SessionMiddlewareWithStore(store)(CSRFMiddleware(Options{Mode: SessionMode})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token = Token(r.Context())
+			utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		})))
+
+	w := httptest.NewRecorder()
+	if _, err := store.Create(context.Background(), w); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	// 1. GET выдаёт токен и сохраняет его в сессии
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || token == "" {
+		t.Fatalf("expected 200 with token, got %d %q", w.Code, token)
+	}
+	cookie = w.Result().Cookies()[0]
+
+	// 2. POST без токена — 403
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without token, got %d", w.Code)
+	}
+
+	// 3. POST с токеном, но с чужого сайта — 403
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	req.AddCookie(cookie)
+	req.Header.Set(HeaderName, token)
+	req.Header.Set("Origin", "http://evil.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for cross-origin request, got %d", w.Code)
+	}
+
+	// 4. POST с токеном со своего origin — проходит
+	req = httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	req.AddCookie(cookie)
+	req.Header.Set(HeaderName, token)
+	req.Header.Set("Origin", "http://example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 with valid token, got %d", w.Code)
+	}
+}
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	handler := CSRFMiddleware(Options{Mode: DoubleSubmitMode})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	// GET выставляет cookie с токеном
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookie := w.Result().Cookies()[0]
+
+	// Токен в заголовке не совпадает с cookie — 403
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.AddCookie(cookie)
+	req.Header.Set(HeaderName, "wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for mismatched token, got %d", w.Code)
+	}
+
+	// Совпадает — проходит
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	req.AddCookie(cookie)
+	req.Header.Set(HeaderName, cookie.Value)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 for matching token, got %d", w.Code)
+	}
+}
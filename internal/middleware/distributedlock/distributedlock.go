@@ -2,9 +2,13 @@ package distributedlock
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-portfolio/http-middleware/internal/utils"
@@ -17,25 +21,82 @@ var (
 	redisClientLock *redis.Client
 	ctxLock         = context.Background()
 
+	// KEYS[1] — блокировка, KEYS[2] — FIFO-очередь ожидающих, KEYS[3] — общий счётчик fencing-токенов (fencingCounterKey).
+	// ARGV[1] — токен владельца, ARGV[2] — TTL в мс, ARGV[3] — "1", если соблюдать очередь.
+	// Возвращает {1, fencing-токен} при захвате и {0, pttl} — иначе; pttl подсказывает, сколько ждать.
+	// В честном режиме захватить блокировку может только голова очереди; головы,
+	// чей ключ присутствия (KEYS[2]:<токен>) истёк, выбрасываются.
 	lockScript = redis.NewScript(`
-if redis.call("SETNX", KEYS[1], ARGV[1]) == 1 then
-    redis.call("PEXPIRE", KEYS[1], ARGV[2])
+if ARGV[3] == "1" then
+    while true do
+        local head = redis.call("LINDEX", KEYS[2], 0)
+        if not head or head == ARGV[1] then
+            break
+        end
+        if redis.call("EXISTS", KEYS[2] .. ":" .. head) == 1 then
+            return {0, redis.call("PTTL", KEYS[1])}
+        end
+        redis.call("LPOP", KEYS[2])
+    end
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+    if ARGV[3] == "1" then
+        redis.call("LREM", KEYS[2], 1, ARGV[1])
+        redis.call("DEL", KEYS[2] .. ":" .. ARGV[1])
+    end
+    return {1, redis.call("INCR", KEYS[3])}
+end
+return {0, redis.call("PTTL", KEYS[1])}
+`)
+
+	// Удаляем ключ, только если он всё ещё принадлежит нам: после истечения TTL
+	// блокировку мог захватить другой клиент. Ожидающих будим через канал ARGV[2].
+	unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    redis.call("DEL", KEYS[1])
+    redis.call("PUBLISH", ARGV[2], "released")
     return 1
 else
     return 0
 end
 `)
 
-	meter       = otel.Meter("distributedlock")
-	lockSuccess metric.Int64Counter
-	lockFailed  metric.Int64Counter
-	lockTime    metric.Float64Histogram
+	// Продлеваем аренду, только если блокировка всё ещё наша.
+	renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+else
+    return 0
+end
+`)
+
+	meter        = otel.Meter("distributedlock")
+	lockSuccess  metric.Int64Counter
+	lockFailed   metric.Int64Counter
+	lockReleased metric.Int64Counter
+	lockRenewed  metric.Int64Counter
+	lockLost     metric.Int64Counter
+	lockTime     metric.Float64Histogram
+	lockWaitTime metric.Float64Histogram
 )
 
+// waitPollInterval — максимальная пауза между попытками при ожидании блокировки.
+// Обычно ожидающего будит сообщение об освобождении или истечение PTTL,
+// а этот интервал страхует от потерянных уведомлений.
+const waitPollInterval = 500 * time.Millisecond
+
+// ErrLockLost — причина отмены контекста запроса, если аренду блокировки не удалось продлить
+// и критическая секция больше не защищена.
+var ErrLockLost = errors.New("distributed lock lost")
+
 func init() {
 	lockSuccess, _ = meter.Int64Counter("lock_success_total")
 	lockFailed, _ = meter.Int64Counter("lock_failed_total")
+	lockReleased, _ = meter.Int64Counter("lock_released_total")
+	lockRenewed, _ = meter.Int64Counter("lock_renewed_total")
+	lockLost, _ = meter.Int64Counter("lock_lost_total")
 	lockTime, _ = meter.Float64Histogram("lock_duration_seconds")
+	lockWaitTime, _ = meter.Float64Histogram("lock_wait_duration_seconds")
 }
 
 func InitRedisLock(addr, password string, db int) error {
@@ -51,27 +112,165 @@ func InitRedisLock(addr, password string, db int) error {
 	return nil
 }
 
+// Options — настройки RedisLockMiddlewareWithOptions.
+type Options struct {
+	// Key — ключ блокировки в Redis.
+	Key string
+	// KeyFunc строит ключ по запросу (см. KeyTemplate); если задан, Key не используется.
+	KeyFunc KeyFunc
+	// TTLMS — время жизни блокировки в миллисекундах.
+	TTLMS int64
+	// HoldUntilTTL — не снимать блокировку после handler'а, а держать до истечения TTL
+	// (режим "cooldown": не чаще одного запроса за TTL).
+	HoldUntilTTL bool
+	// DisableRenewal отключает watchdog, который продлевает аренду, пока работает handler.
+	// Без него блокировка истекает через TTLMS, даже если handler ещё не закончил.
+	DisableRenewal bool
+	// WaitTimeout — сколько ждать освобождения занятой блокировки (0 — сразу 429).
+	// Ожидание также ограничено контекстом запроса.
+	WaitTimeout time.Duration
+	// Fair — при ожидании выдавать блокировку в порядке очереди (FIFO).
+	Fair bool
+}
+
+// lockKey возвращает ключ блокировки для запроса: из KeyFunc, если он задан, иначе Key.
+func (opts Options) lockKey(r *http.Request) (string, error) {
+	if opts.KeyFunc != nil {
+		return opts.KeyFunc(r)
+	}
+	return opts.Key, nil
+}
+
+// RedisLockMiddleware захватывает блокировку lockKey на время обработки запроса
+// и снимает её после handler'а. Если блокировка занята — 429.
 func RedisLockMiddleware(lockKey string, ttlMS int64) func(http.Handler) http.Handler {
+	return RedisLockMiddlewareWithOptions(Options{Key: lockKey, TTLMS: ttlMS})
+}
+
+// RedisLockMiddlewareWithOptions — RedisLockMiddleware с дополнительными настройками.
+func RedisLockMiddlewareWithOptions(opts Options) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			start := time.Now()
-			defer lockTime.Record(r.Context(), time.Since(start).Seconds())
-
 			ip, _, err := net.SplitHostPort(r.RemoteAddr)
 			if err != nil {
 				ip = r.RemoteAddr
 			}
-			clientID := ip + ":" + fmt.Sprint(time.Now().UnixNano())
+			owner, err := newOwnerToken(ip)
+			if err != nil {
+				lockFailed.Add(r.Context(), 1)
+				next.ServeHTTP(w, r)
+				return
+			}
 
-			res, err := lockScript.Run(ctxLock, redisClientLock, []string{lockKey}, clientID, ttlMS).Result()
+			lockKey, err := opts.lockKey(r)
+			if err != nil {
+				lockFailed.Add(r.Context(), 1)
+				utils.JSON(w, http.StatusBadRequest, map[string]string{
+					"error": "cannot build lock key: " + err.Error(),
+				})
+				return
+			}
+
+			token, acquired, err := acquire(r.Context(), lockKey, owner, opts)
+			if err != nil {
+				lockFailed.Add(r.Context(), 1)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !acquired {
+				lockFailed.Add(r.Context(), 1)
+				utils.JSON(w, http.StatusTooManyRequests, map[string]string{
+					"error": "resource is locked",
+				})
+				return
+			}
+
+			lockSuccess.Add(r.Context(), 1)
+			// lock_duration_seconds — только удержание: ожидание уже записано в lock_wait_duration_seconds
+			held := time.Now()
+			defer func() {
+				lockTime.Record(r.Context(), time.Since(held).Seconds())
+			}()
+			w.Header().Set("X-Fencing-Token", strconv.FormatInt(token, 10))
+			r = r.WithContext(context.WithValue(r.Context(), fencingContextKey{}, token))
+			if opts.HoldUntilTTL {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// defer снимает блокировку и при панике в handler'е.
+			// Watchdog останавливается раньше, чем блокировка снимается.
+			defer release(r.Context(), lockKey, lockKey, owner)
+			if !opts.DisableRenewal {
+				ctx, stop := startWatchdog(r.Context(), opts.TTLMS, 0, func() (time.Duration, bool, error) {
+					renewed, err := renew(ctxLock, redisClientLock, lockKey, owner, opts.TTLMS)
+					return 0, renewed, err
+				})
+				defer stop()
+				r = r.WithContext(ctx)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// lease — операции одного вида блокировки (Redlock, чтение/запись, семафор)
+// для общего middleware leaseMiddleware.
+type lease struct {
+	// acquire захватывает блокировку (с ожиданием до opts.WaitTimeout). Возвращает время
+	// действия захвата, если оно короче TTL (Redlock), иначе 0.
+	acquire func(ctx context.Context, key, owner string) (time.Duration, bool, error)
+	// release снимает блокировку, если она всё ещё принадлежит owner.
+	release func(ctx context.Context, key, owner string)
+	// renew продлевает аренду для watchdog'а. Время действия — как у acquire.
+	renew func(key, owner string) (time.Duration, bool, error)
+}
+
+// leaseMiddleware — общий каркас middleware без fencing-токенов: строит ключ,
+// захватывает блокировку через lease, выбранный для запроса, отвечает 429, если она
+// занята, и снимает её (или держит до TTL) после handler'а. Ошибки Redis — fail-open,
+// кроме ErrQuorumUnavailable: без большинства узлов Redlock ничего не защищает — 503.
+// Если известно время действия захвата, контекст запроса отменяется с ErrLockLost,
+// когда оно истекает без продления.
+func leaseMiddleware(opts Options, leaseFor func(r *http.Request) lease) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lockKey, err := opts.lockKey(r)
+			if err != nil {
+				lockFailed.Add(r.Context(), 1)
+				utils.JSON(w, http.StatusBadRequest, map[string]string{
+					"error": "cannot build lock key: " + err.Error(),
+				})
+				return
+			}
+
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			owner, err := newOwnerToken(ip)
 			if err != nil {
 				lockFailed.Add(r.Context(), 1)
 				next.ServeHTTP(w, r)
 				return
 			}
 
-			locked, ok := res.(int64)
-			if !ok || locked == 0 {
+			l := leaseFor(r)
+			valid, acquired, err := l.acquire(r.Context(), lockKey, owner)
+			if errors.Is(err, ErrQuorumUnavailable) {
+				lockFailed.Add(r.Context(), 1)
+				utils.JSON(w, http.StatusServiceUnavailable, map[string]string{
+					"error": "lock quorum unavailable",
+				})
+				return
+			}
+			if err != nil {
+				lockFailed.Add(r.Context(), 1)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !acquired {
 				lockFailed.Add(r.Context(), 1)
 				utils.JSON(w, http.StatusTooManyRequests, map[string]string{
 					"error": "resource is locked",
@@ -80,7 +279,242 @@ func RedisLockMiddleware(lockKey string, ttlMS int64) func(http.Handler) http.Ha
 			}
 
 			lockSuccess.Add(r.Context(), 1)
+			held := time.Now()
+			defer func() {
+				lockTime.Record(r.Context(), time.Since(held).Seconds())
+			}()
+			if opts.HoldUntilTTL {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			defer l.release(r.Context(), lockKey, owner)
+			switch {
+			case !opts.DisableRenewal:
+				ctx, stop := startWatchdog(r.Context(), opts.TTLMS, valid, func() (time.Duration, bool, error) {
+					return l.renew(lockKey, owner)
+				})
+				defer stop()
+				r = r.WithContext(ctx)
+			case valid > 0:
+				ctx, cancel := context.WithDeadlineCause(r.Context(), time.Now().Add(valid), ErrLockLost)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// newOwnerToken генерирует уникальный токен владельца блокировки.
+// IP клиента в префиксе помогает понять, кто держит блокировку.
+func newOwnerToken(ip string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return ip + ":" + hex.EncodeToString(buf), nil
+}
+
+func waitersKey(key string) string {
+	return key + ":waiters"
+}
+
+func releasedChannel(key string) string {
+	return key + ":released"
+}
+
+// fencingCounterKey — общий счётчик fencing-токенов всех блокировок. Токены одного ключа
+// всё равно строго возрастают, а число ключей не растёт с числом заблокированных ресурсов
+// (счётчик на каждый ключ жил бы вечно: с TTL он мог бы начаться заново и выдать токен
+// меньше уже принятого хранилищем).
+const fencingCounterKey = "lock:fencing"
+
+// tryAcquire делает одну попытку захвата. Возвращает, захвачена ли блокировка,
+// и fencing-токен при захвате или оставшийся PTTL в мс, если блокировка занята.
+func tryAcquire(key, owner string, ttlMS int64, fair bool) (bool, int64, error) {
+	fairArg := "0"
+	if fair {
+		fairArg = "1"
+	}
+	res, err := lockScript.Run(ctxLock, redisClientLock, []string{key, waitersKey(key), fencingCounterKey}, owner, ttlMS, fairArg).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected lock script result: %v", res)
+	}
+	locked, _ := values[0].(int64)
+	value, _ := values[1].(int64)
+	return locked == 1, value, nil
+}
+
+// acquire захватывает блокировку. С WaitTimeout ждёт её освобождения (см. waitFor),
+// в честном режиме — встав в очередь <key>:waiters.
+// Возвращает fencing-токен захваченной блокировки.
+func acquire(ctx context.Context, key, owner string, opts Options) (int64, bool, error) {
+	fair := opts.Fair && opts.WaitTimeout > 0
+	if opts.WaitTimeout <= 0 {
+		locked, token, err := tryAcquire(key, owner, opts.TTLMS, false)
+		return token, locked, err
+	}
+
+	if fair {
+		_, err := redisClientLock.TxPipelined(ctxLock, func(pipe redis.Pipeliner) error {
+			pipe.RPush(ctxLock, waitersKey(key), owner)
+			pipe.PExpire(ctxLock, waitersKey(key), opts.WaitTimeout+time.Duration(opts.TTLMS)*time.Millisecond)
+			return nil
+		})
+		if err != nil {
+			return 0, false, err
+		}
+		// Если не дождались, убираем себя из очереди, чтобы не задерживать остальных
+		defer func() {
+			redisClientLock.LRem(ctxLock, waitersKey(key), 1, owner)
+			redisClientLock.Del(ctxLock, waitersKey(key)+":"+owner)
+		}()
+	}
+
+	var token int64
+	acquired, err := waitFor(ctx, key, opts.WaitTimeout, func() (bool, time.Duration, error) {
+		if fair {
+			// Ключ присутствия показывает остальным, что ожидающий жив
+			redisClientLock.Set(ctxLock, waitersKey(key)+":"+owner, 1, 3*waitPollInterval)
+		}
+
+		locked, value, err := tryAcquire(key, owner, opts.TTLMS, fair)
+		if locked {
+			token = value
+			return true, 0, nil
+		}
+		return false, time.Duration(value) * time.Millisecond, err
+	})
+	return token, acquired, err
+}
+
+// waitFor повторяет try, пока она не захватит блокировку key, не вернёт ошибку
+// или не истечёт timeout либо контекст запроса. Подписывается на канал <key>:released
+// и повторяет попытку по уведомлению, через подсказку retryIn от try (например, PTTL)
+// или раз в waitPollInterval.
+func waitFor(ctx context.Context, key string, timeout time.Duration, try func() (acquired bool, retryIn time.Duration, err error)) (bool, error) {
+	start := time.Now()
+	defer func() {
+		lockWaitTime.Record(ctx, time.Since(start).Seconds())
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Подписываемся до первой попытки, чтобы не пропустить освобождение между попыткой и ожиданием
+	sub := redisClientLock.Subscribe(ctx, releasedChannel(key))
+	defer sub.Close()
+	var released <-chan *redis.Message
+	if _, err := sub.Receive(ctx); err == nil {
+		released = sub.Channel()
+	}
+
+	for {
+		acquired, retryIn, err := try()
+		if err != nil || acquired {
+			return acquired, err
+		}
+
+		wait := waitPollInterval
+		if retryIn > 0 && retryIn < wait {
+			wait = retryIn
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false, nil
+		case <-released:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// renew продлевает аренду блокировки на одном узле Redis, если она всё ещё принадлежит owner.
+func renew(ctx context.Context, client *redis.Client, key, owner string, ttlMS int64) (bool, error) {
+	res, err := renewScript.Run(ctx, client, []string{key}, owner, ttlMS).Result()
+	if err != nil {
+		return false, err
+	}
+	renewed, ok := res.(int64)
+	return ok && renewed == 1, nil
+}
+
+// startWatchdog вызывает renew каждые TTL/3, пока работает handler.
+// Аренда действует valid с захвата (0 — TTL), а после продления — столько, сколько вернул
+// renew (0 — TTL) с момента начала продления. Если блокировку перехватили или срок аренды
+// истёк без продления, контекст запроса отменяется с причиной ErrLockLost.
+// stop дожидается завершения горутины.
+func startWatchdog(parent context.Context, ttlMS int64, valid time.Duration, renew func() (time.Duration, bool, error)) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ttl := time.Duration(ttlMS) * time.Millisecond
+	if valid <= 0 {
+		valid = ttl
+	}
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		expired := time.NewTimer(valid)
+		defer expired.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-expired.C:
+				// Продлить не успели: аренда истекла, критическая секция не защищена
+				lockLost.Add(parent, 1)
+				cancel(ErrLockLost)
+				return
+			case <-ticker.C:
+			}
+
+			started := time.Now()
+			v, renewed, err := renew()
+			if err != nil {
+				// Временная ошибка Redis: пробуем ещё раз, пока аренда не истекла
+				continue
+			}
+			if !renewed {
+				lockLost.Add(parent, 1)
+				cancel(ErrLockLost)
+				return
+			}
+			if v <= 0 {
+				v = ttl
+			}
+			expired.Reset(time.Until(started.Add(v)))
+			lockRenewed.Add(parent, 1)
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		<-stopped
+		cancel(nil)
+	}
+}
+
+// release снимает блокировку key, если она всё ещё принадлежит owner, и будит ожидающих
+// блокировку waitKey (обычно совпадает с key).
+func release(ctx context.Context, key, waitKey, owner string) {
+	res, err := unlockScript.Run(ctxLock, redisClientLock, []string{key}, owner, releasedChannel(waitKey)).Result()
+	if err != nil {
+		return
+	}
+	if deleted, ok := res.(int64); ok && deleted == 1 {
+		lockReleased.Add(ctx, 1)
+	}
+}
@@ -1,8 +1,12 @@
 package distributedlock
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,8 +24,8 @@ func TestRedisLockMiddleware(t *testing.T) {
 	// Очистка ключа перед тестом
 	redisClientLock.Del(ctxLock, lockKey)
 
-	// Простая заглушка handler
-	handler := RedisLockMiddleware(lockKey, 500)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// Простая заглушка handler. Режим cooldown: блокировка держится до истечения TTL
+	handler := RedisLockMiddlewareWithOptions(Options{Key: lockKey, TTLMS: 500, HoldUntilTTL: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
 	}))
 
@@ -55,3 +59,231 @@ func TestRedisLockMiddleware(t *testing.T) {
 		t.Errorf("expected 200 OK after TTL expiration, got %d", w3.Code)
 	}
 }
+
+func TestRedisLockMiddlewareRelease(t *testing.T) {
+	if err := InitRedisLock("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+
+	lockKey := "lock:order:release"
+	redisClientLock.Del(ctxLock, lockKey)
+
+	handler := RedisLockMiddleware(lockKey, 5000)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	// Блокировка снимается после handler'а, поэтому последовательные запросы проходят
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("request %d: expected 200, got %d", i+1, w.Code)
+		}
+	}
+
+	// Паника в handler'е тоже снимает блокировку
+	panicking := RedisLockMiddleware(lockKey, 5000)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	func() {
+		defer func() { _ = recover() }()
+		panicking.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	if n, _ := redisClientLock.Exists(ctxLock, lockKey).Result(); n != 0 {
+		t.Errorf("expected lock to be released after panic")
+	}
+
+	// Чужую блокировку снять нельзя
+	redisClientLock.Set(ctxLock, lockKey, "someone-else", 0)
+	release(ctxLock, lockKey, lockKey, "me")
+	if v, _ := redisClientLock.Get(ctxLock, lockKey).Result(); v != "someone-else" {
+		t.Errorf("expected foreign lock to stay, got %q", v)
+	}
+	redisClientLock.Del(ctxLock, lockKey)
+}
+
+func TestKeyTemplate(t *testing.T) {
+	keyFunc, err := KeyTemplate("lock:order:{header:X-Tenant}:{orderId}:{json:item.sku}")
+	if err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/order/42", strings.NewReader(`{"item":{"sku":"a:b"}}`))
+	req.SetPathValue("orderId", "42")
+	req.Header.Set("X-Tenant", "acme")
+
+	key, err := keyFunc(req)
+	if err != nil {
+		t.Fatalf("failed to build key: %v", err)
+	}
+	// Двоеточие из значения экранируется и не создаёт лишний уровень ключа
+	if key != "lock:order:acme:42:a%3Ab" {
+		t.Errorf("unexpected key %q", key)
+	}
+
+	// Тело запроса остаётся доступным handler'у
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != `{"item":{"sku":"a:b"}}` {
+		t.Errorf("expected body to be restored, got %q", body)
+	}
+
+	// Отсутствующее значение — ошибка
+	if _, err := keyFunc(httptest.NewRequest(http.MethodPost, "/order", nil)); err == nil {
+		t.Errorf("expected error for missing key parts")
+	}
+
+	// Длинный ключ обрезается до MaxKeyLength
+	long, _ := KeyTemplate("lock:{query:id}")
+	key, _ = long(httptest.NewRequest(http.MethodGet, "/?id="+strings.Repeat("x", 500), nil))
+	if len(key) != MaxKeyLength {
+		t.Errorf("expected key length %d, got %d", MaxKeyLength, len(key))
+	}
+
+	if _, err := KeyTemplate("lock:{cookie:id}"); err == nil {
+		t.Errorf("expected error for unknown placeholder source")
+	}
+}
+
+func TestRedisLockMiddlewareWait(t *testing.T) {
+	if err := InitRedisLock("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+
+	lockKey := "lock:order:wait"
+	redisClientLock.Del(ctxLock, lockKey, waitersKey(lockKey))
+
+	var mu sync.Mutex
+	var order []string
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		order = append(order, r.URL.Query().Get("id"))
+		mu.Unlock()
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	waiting := RedisLockMiddlewareWithOptions(Options{Key: lockKey, TTLMS: 5000, WaitTimeout: 2 * time.Second, Fair: true})(slow)
+	impatient := RedisLockMiddlewareWithOptions(Options{Key: lockKey, TTLMS: 5000, WaitTimeout: 20 * time.Millisecond, Fair: true})(slow)
+
+	// Первый запрос держит блокировку, следующие встают в очередь по порядку
+	var wg sync.WaitGroup
+	codes := make(map[string]int)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			waiting.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?id="+id, nil))
+			mu.Lock()
+			codes[id] = w.Code
+			mu.Unlock()
+		}(id)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Запрос с коротким ожиданием не дожидается своей очереди
+	w := httptest.NewRecorder()
+	impatient.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?id=x", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after wait timeout, got %d", w.Code)
+	}
+
+	wg.Wait()
+	for id, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %s: expected 200 after waiting, got %d", id, code)
+		}
+	}
+	if strings.Join(order, "") != "abcd" {
+		t.Errorf("expected FIFO order abcd, got %v", order)
+	}
+}
+
+func TestRedisLockWatchdog(t *testing.T) {
+	if err := InitRedisLock("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+
+	lockKey := "lock:order:watchdog"
+	redisClientLock.Del(ctxLock, lockKey)
+
+	// Handler работает дольше TTL, но watchdog продлевает аренду
+	long := RedisLockMiddleware(lockKey, 300)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(700 * time.Millisecond)
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		long.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		done <- w.Code
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	w := httptest.NewRecorder()
+	long.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected lock to be held past TTL, got %d", w.Code)
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected 200 for long handler, got %d", code)
+	}
+
+	// Если блокировку перехватили, контекст handler'а отменяется с ErrLockLost
+	var cause error
+	lost := RedisLockMiddleware(lockKey, 300)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redisClientLock.Set(ctxLock, lockKey, "someone-else", 0)
+		<-r.Context().Done()
+		cause = context.Cause(r.Context())
+	}))
+	lost.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	if cause != ErrLockLost {
+		t.Errorf("expected ErrLockLost, got %v", cause)
+	}
+	redisClientLock.Del(ctxLock, lockKey)
+}
+
+func TestFencingToken(t *testing.T) {
+	if err := InitRedisLock("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+
+	lockKey := "lock:order:fencing"
+	redisClientLock.Del(ctxLock, lockKey, lockKey+":fencing", "resource:fencing", "resource:fencing:fence")
+
+	var tokens []int64
+	handler := RedisLockMiddleware(lockKey, 5000)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := FencingToken(r.Context())
+		if !ok {
+			t.Errorf("expected fencing token in context")
+		}
+		tokens = append(tokens, token)
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		if w.Header().Get("X-Fencing-Token") == "" {
+			t.Errorf("expected X-Fencing-Token header")
+		}
+	}
+	if len(tokens) != 2 || tokens[1] <= tokens[0] {
+		t.Fatalf("expected increasing fencing tokens, got %v", tokens)
+	}
+	// Токены берутся из общего счётчика: на ключ блокировки отдельный счётчик не заводится
+	if n := redisClientLock.Exists(ctxLock, lockKey+":fencing").Val(); n != 0 {
+		t.Errorf("expected no per-key fencing counter")
+	}
+
+	// Запись с новым токеном проходит, с устаревшим — отклоняется
+	if err := FencedSet(ctxLock, redisClientLock, "resource:fencing", "new", tokens[1]); err != nil {
+		t.Fatalf("expected write with current token to pass: %v", err)
+	}
+	if err := FencedSet(ctxLock, redisClientLock, "resource:fencing", "stale", tokens[0]); err != ErrStaleToken {
+		t.Errorf("expected ErrStaleToken, got %v", err)
+	}
+	if v, _ := redisClientLock.Get(ctxLock, "resource:fencing").Result(); v != "new" {
+		t.Errorf("expected value to stay %q, got %q", "new", v)
+	}
+}
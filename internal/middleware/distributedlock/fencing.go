@@ -0,0 +1,66 @@
+package distributedlock
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type fencingContextKey struct{}
+
+// FencingToken возвращает fencing-токен блокировки, захваченной для текущего запроса.
+// Токены строго возрастают при каждом захвате одного и того же ключа, поэтому хранилище
+// может отвергнуть запись от клиента, чья блокировка уже истекла и была перехвачена.
+// Тот же токен отдаётся клиенту в заголовке X-Fencing-Token.
+func FencingToken(ctx context.Context) (int64, bool) {
+	token, ok := ctx.Value(fencingContextKey{}).(int64)
+	return token, ok
+}
+
+// ErrStaleToken — запись отклонена: её fencing-токен старше уже принятого.
+var ErrStaleToken = errors.New("stale fencing token")
+
+// staleTokenReply — текст ошибки, которую возвращает проверка в FencedScript.
+const staleTokenReply = "STALE_FENCING_TOKEN"
+
+// fencingGuard проверяет токен до выполнения основного скрипта.
+// Последний элемент KEYS — ключ с последним принятым токеном, последний элемент ARGV — токен.
+const fencingGuard = `
+local fenceKey = KEYS[#KEYS]
+local fenceToken = tonumber(ARGV[#ARGV])
+local lastToken = tonumber(redis.call("GET", fenceKey) or "0")
+if fenceToken < lastToken then
+    return redis.error_reply("` + staleTokenReply + `")
+end
+redis.call("SET", fenceKey, fenceToken)
+`
+
+// FencedScript оборачивает Lua-скрипт записи (например, compare-and-set из stateupdate)
+// проверкой fencing-токена. При вызове последним ключом передаётся ключ с последним
+// принятым токеном, последним аргументом — токен из FencingToken. Устаревшая запись
+// не выполняется, а Run возвращает ошибку, для которой IsStaleToken == true.
+func FencedScript(body string) *redis.Script {
+	return redis.NewScript(fencingGuard + body)
+}
+
+// IsStaleToken сообщает, что ошибка скрипта вызвана устаревшим fencing-токеном.
+func IsStaleToken(err error) bool {
+	return err != nil && (errors.Is(err, ErrStaleToken) || strings.Contains(err.Error(), staleTokenReply))
+}
+
+var fencedSetScript = FencedScript(`
+redis.call("SET", KEYS[1], ARGV[1])
+return 1
+`)
+
+// FencedSet записывает value в key, только если token не старше последнего принятого
+// для key (хранится в <key>:fence). Иначе возвращает ErrStaleToken.
+func FencedSet(ctx context.Context, client *redis.Client, key, value string, token int64) error {
+	err := fencedSetScript.Run(ctx, client, []string{key, key + ":fence"}, value, token).Err()
+	if IsStaleToken(err) {
+		return ErrStaleToken
+	}
+	return err
+}
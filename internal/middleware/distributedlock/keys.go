@@ -0,0 +1,141 @@
+package distributedlock
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-portfolio/http-middleware/internal/middleware/session"
+	"github.com/go-portfolio/http-middleware/internal/utils"
+)
+
+// MaxKeyLength — предел длины ключа блокировки. Более длинный ключ
+// обрезается и дополняется SHA-256 от полного значения.
+const MaxKeyLength = 200
+
+// KeyFunc строит ключ блокировки по запросу.
+type KeyFunc func(r *http.Request) (string, error)
+
+// ErrMissingKeyPart — в запросе нет значения для плейсхолдера шаблона ключа.
+var ErrMissingKeyPart = errors.New("missing lock key part")
+
+type keyPart struct {
+	literal string
+	source  string
+	name    string
+}
+
+// KeyTemplate собирает KeyFunc из шаблона вида "lock:order:{user}:{orderId}".
+//
+// Плейсхолдеры:
+//   - {name} — параметр пути (r.PathValue), а если его нет — параметр query;
+//   - {path:name}, {query:name}, {header:Name} — явный источник;
+//   - {json:field} или {json:a.b} — поле JSON-тела запроса (тело после чтения восстанавливается);
+//   - {user} — владелец сессии (session.FromContext(ctx).UserID). Работает, только если
+//     перед блокировкой стоит session.SessionMiddleware; auth.Auth пользователя не определяет.
+//
+// Значения экранируются, поэтому ':' и '{' из запроса не ломают структуру ключа.
+func KeyTemplate(tmpl string) (KeyFunc, error) {
+	var parts []keyPart
+	rest := tmpl
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			parts = append(parts, keyPart{literal: rest})
+			break
+		}
+		if open > 0 {
+			parts = append(parts, keyPart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in lock key template %q", tmpl)
+		}
+		placeholder := rest[open+1 : open+end]
+		rest = rest[open+end+1:]
+
+		part := keyPart{name: placeholder}
+		if i := strings.IndexByte(placeholder, ':'); i >= 0 {
+			part.source, part.name = placeholder[:i], placeholder[i+1:]
+		}
+		if placeholder == "user" {
+			part.source = "user"
+		}
+		switch part.source {
+		case "", "path", "query", "header", "json", "user":
+		default:
+			return nil, fmt.Errorf("unknown placeholder source %q in lock key template %q", part.source, tmpl)
+		}
+		if part.name == "" {
+			return nil, fmt.Errorf("empty placeholder in lock key template %q", tmpl)
+		}
+		parts = append(parts, part)
+	}
+
+	return func(r *http.Request) (string, error) {
+		var b strings.Builder
+		var body map[string]interface{}
+		for _, part := range parts {
+			if part.literal != "" {
+				b.WriteString(part.literal)
+				continue
+			}
+
+			var value string
+			switch part.source {
+			case "":
+				if value = r.PathValue(part.name); value == "" {
+					value = r.URL.Query().Get(part.name)
+				}
+			case "path":
+				value = r.PathValue(part.name)
+			case "query":
+				value = r.URL.Query().Get(part.name)
+			case "header":
+				value = r.Header.Get(part.name)
+			case "user":
+				s := session.FromContext(r.Context())
+				if s == nil {
+					return "", fmt.Errorf("%w: user (no session middleware)", ErrMissingKeyPart)
+				}
+				value = s.UserID
+			case "json":
+				if body == nil {
+					var err error
+					if body, err = utils.ReadJSONBody(r); err != nil {
+						return "", err
+					}
+				}
+				value = utils.JSONField(body, part.name)
+			}
+
+			if value == "" {
+				return "", fmt.Errorf("%w: %s", ErrMissingKeyPart, part.name)
+			}
+			b.WriteString(url.QueryEscape(value))
+		}
+		return capKey(b.String()), nil
+	}, nil
+}
+
+// MustKeyTemplate — KeyTemplate, паникующий на некорректном шаблоне. Удобен при сборке маршрутов.
+func MustKeyTemplate(tmpl string) KeyFunc {
+	fn, err := KeyTemplate(tmpl)
+	if err != nil {
+		panic(err)
+	}
+	return fn
+}
+
+// capKey ограничивает длину ключа, сохраняя уникальность за счёт хэша.
+func capKey(key string) string {
+	if len(key) <= MaxKeyLength {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return key[:MaxKeyLength-len(sum)*2-1] + ":" + hex.EncodeToString(sum[:])
+}
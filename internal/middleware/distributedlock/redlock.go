@@ -0,0 +1,183 @@
+package distributedlock
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// defaultNodeTimeout — сколько ждать ответа одного узла. Должно быть много меньше TTL,
+	// чтобы недоступный узел не съедал время жизни блокировки.
+	defaultNodeTimeout = 50 * time.Millisecond
+	// defaultDriftFactor — доля TTL, закладываемая на расхождение часов узлов.
+	defaultDriftFactor = 0.01
+)
+
+// Redlock — блокировка на N независимых узлах Redis (алгоритм Redlock).
+// Блокировка считается захваченной, если её удалось поставить на большинстве узлов
+// и после этого осталось положительное время действия. Так отказ одного узла
+// не отключает блокировки и не выдаёт одну блокировку двум клиентам.
+type Redlock struct {
+	clients []*redis.Client
+
+	// NodeTimeout — таймаут запроса к одному узлу.
+	NodeTimeout time.Duration
+	// DriftFactor — доля TTL на расхождение часов (к ней добавляются 2 мс).
+	DriftFactor float64
+}
+
+// NewRedlock создаёт Redlock поверх независимых (не реплицируемых между собой) узлов Redis.
+func NewRedlock(clients ...*redis.Client) *Redlock {
+	return &Redlock{
+		clients:     clients,
+		NodeTimeout: defaultNodeTimeout,
+		DriftFactor: defaultDriftFactor,
+	}
+}
+
+func (rl *Redlock) quorum() int {
+	return len(rl.clients)/2 + 1
+}
+
+// onAllNodes параллельно выполняет fn на каждом узле и считает успешные ответы и ошибки.
+func (rl *Redlock) onAllNodes(fn func(ctx context.Context, client *redis.Client) (bool, error)) (succeeded, failed int) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, client := range rl.clients {
+		wg.Add(1)
+		go func(client *redis.Client) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctxLock, rl.NodeTimeout)
+			defer cancel()
+			ok, err := fn(ctx, client)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+			} else if ok {
+				succeeded++
+			}
+		}(client)
+	}
+	wg.Wait()
+	return succeeded, failed
+}
+
+// Lock пытается один раз захватить key на всех узлах. Возвращает оставшееся время
+// действия блокировки и true при успехе. Ошибка возвращается, если недоступно столько
+// узлов, что большинство собрать невозможно.
+func (rl *Redlock) Lock(key, owner string, ttl time.Duration) (time.Duration, bool, error) {
+	start := time.Now()
+	succeeded, failed := rl.onAllNodes(func(ctx context.Context, client *redis.Client) (bool, error) {
+		return client.SetNX(ctx, key, owner, ttl).Result()
+	})
+
+	validity := rl.validity(ttl, start)
+	if succeeded >= rl.quorum() && validity > 0 {
+		return validity, true, nil
+	}
+
+	// Не набрали большинство — снимаем то, что успели поставить
+	rl.Unlock(key, owner)
+	if failed > len(rl.clients)-rl.quorum() {
+		return 0, false, ErrQuorumUnavailable
+	}
+	return 0, false, nil
+}
+
+// Extend продлевает блокировку на всех узлах; успешно, если продлить удалось на большинстве
+// и осталось положительное время действия. Возвращает его, как и Lock.
+func (rl *Redlock) Extend(key, owner string, ttl time.Duration) (time.Duration, bool, error) {
+	start := time.Now()
+	succeeded, failed := rl.onAllNodes(func(ctx context.Context, client *redis.Client) (bool, error) {
+		return renew(ctx, client, key, owner, ttl.Milliseconds())
+	})
+	if validity := rl.validity(ttl, start); succeeded >= rl.quorum() && validity > 0 {
+		return validity, true, nil
+	}
+	if failed > len(rl.clients)-rl.quorum() {
+		return 0, false, ErrQuorumUnavailable
+	}
+	return 0, false, nil
+}
+
+// validity — сколько ещё действует блокировка с TTL ttl, поставленная начиная со start:
+// TTL за вычетом времени захвата и поправки на расхождение часов.
+func (rl *Redlock) validity(ttl time.Duration, start time.Time) time.Duration {
+	drift := time.Duration(float64(ttl)*rl.DriftFactor) + 2*time.Millisecond
+	return ttl - time.Since(start) - drift
+}
+
+// Unlock снимает блокировку на всех узлах, где она принадлежит owner,
+// включая узлы, ответившие на захват ошибкой или по таймауту.
+func (rl *Redlock) Unlock(key, owner string) {
+	rl.onAllNodes(func(ctx context.Context, client *redis.Client) (bool, error) {
+		err := unlockScript.Run(ctx, client, []string{key}, owner, releasedChannel(key)).Err()
+		return err == nil, err
+	})
+}
+
+// ErrQuorumUnavailable — недоступно столько узлов, что большинство собрать невозможно.
+var ErrQuorumUnavailable = errors.New("redlock: quorum of nodes unavailable")
+
+// RedlockMiddleware — RedisLockMiddlewareWithOptions поверх Redlock.
+// Поддерживаются Key/KeyFunc, TTLMS, HoldUntilTTL, WaitTimeout (повторные попытки
+// со случайной паузой) и продление аренды на большинстве узлов. Fair и fencing-токены
+// не поддерживаются: у независимых узлов нет общей очереди и общего счётчика.
+//
+// В отличие от одиночной блокировки, недоступность большинства узлов не fail-open:
+// запрос отклоняется с 503. Контекст запроса отменяется с ErrLockLost, когда истекает
+// время действия блокировки (TTL минус время захвата и поправка на часы) без продления.
+func RedlockMiddleware(rl *Redlock, opts Options) func(http.Handler) http.Handler {
+	ttl := time.Duration(opts.TTLMS) * time.Millisecond
+	l := lease{
+		acquire: func(ctx context.Context, key, owner string) (time.Duration, bool, error) {
+			return rl.acquire(ctx, key, owner, ttl, opts.WaitTimeout)
+		},
+		release: func(ctx context.Context, key, owner string) {
+			rl.Unlock(key, owner)
+		},
+		renew: func(key, owner string) (time.Duration, bool, error) {
+			return rl.Extend(key, owner, ttl)
+		},
+	}
+	return leaseMiddleware(opts, func(r *http.Request) lease { return l })
+}
+
+// acquire повторяет Lock со случайной паузой, пока не истечёт waitTimeout или контекст запроса.
+// Возвращает время действия захваченной блокировки.
+func (rl *Redlock) acquire(ctx context.Context, key, owner string, ttl, waitTimeout time.Duration) (time.Duration, bool, error) {
+	start := time.Now()
+	if waitTimeout > 0 {
+		defer func() {
+			lockWaitTime.Record(ctx, time.Since(start).Seconds())
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, waitTimeout)
+	defer cancel()
+
+	for {
+		validity, locked, err := rl.Lock(key, owner, ttl)
+		if err != nil || locked {
+			return validity, locked, err
+		}
+
+		// Случайная пауза разводит конкурентов, которые одновременно разбили голоса узлов
+		delay := waitPollInterval/10 + time.Duration(rand.Int63n(int64(waitPollInterval/5)))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, false, nil
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package distributedlock
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRedlock(t *testing.T) {
+	// Redlock нужны независимые узлы, поэтому поднимаем три in-process сервера Redis
+	var servers []*miniredis.Miniredis
+	var clients []*redis.Client
+	for i := 0; i < 3; i++ {
+		srv := miniredis.RunT(t)
+		servers = append(servers, srv)
+		clients = append(clients, redis.NewClient(&redis.Options{Addr: srv.Addr()}))
+	}
+	rl := NewRedlock(clients...)
+
+	// 1. Захват на всех узлах
+	validity, ok, err := rl.Lock("lock:redlock", "owner-1", time.Second)
+	if err != nil || !ok {
+		t.Fatalf("expected lock to be acquired, got ok=%v err=%v", ok, err)
+	}
+	if validity <= 0 || validity > time.Second {
+		t.Errorf("unexpected validity %v", validity)
+	}
+
+	// 2. Второй владелец не набирает большинство
+	if _, ok, _ := rl.Lock("lock:redlock", "owner-2", time.Second); ok {
+		t.Errorf("expected second owner to fail")
+	}
+
+	// 3. Снятие блокировки на всех узлах
+	rl.Unlock("lock:redlock", "owner-1")
+	for i, srv := range servers {
+		if srv.Exists("lock:redlock") {
+			t.Errorf("node %d: expected lock to be released", i)
+		}
+	}
+
+	// 4. Один узел недоступен — большинство (2 из 3) всё ещё набирается
+	servers[0].Close()
+	if _, ok, err := rl.Lock("lock:redlock", "owner-3", time.Second); !ok || err != nil {
+		t.Errorf("expected lock with one node down, got ok=%v err=%v", ok, err)
+	}
+	rl.Unlock("lock:redlock", "owner-3")
+
+	// 5. Два узла недоступны — большинство недостижимо
+	servers[1].Close()
+	if _, ok, err := rl.Lock("lock:redlock", "owner-4", time.Second); ok || err != ErrQuorumUnavailable {
+		t.Errorf("expected ErrQuorumUnavailable, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestRedlockMiddleware(t *testing.T) {
+	var servers []*miniredis.Miniredis
+	var clients []*redis.Client
+	for i := 0; i < 3; i++ {
+		srv := miniredis.RunT(t)
+		servers = append(servers, srv)
+		clients = append(clients, redis.NewClient(&redis.Options{Addr: srv.Addr()}))
+	}
+	rl := NewRedlock(clients...)
+
+	// Пока handler держит блокировку, параллельный запрос получает 429
+	var inner int
+	var handler http.Handler
+	handler = RedlockMiddleware(rl, Options{Key: "lock:redlock:mw", TTLMS: 1000})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("nested") == "" {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/?nested=1", nil))
+			inner = rec.Code
+		}
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if inner != http.StatusTooManyRequests {
+		t.Errorf("expected 429 while locked, got %d", inner)
+	}
+
+	// После handler'а блокировка снята
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?nested=skip", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 after release, got %d", w.Code)
+	}
+
+	// Без продления контекст отменяется, когда истекает время действия блокировки
+	var cause error
+	expiring := RedlockMiddleware(rl, Options{Key: "lock:redlock:expiring", TTLMS: 200, DisableRenewal: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cause = context.Cause(r.Context())
+		case <-time.After(time.Second):
+		}
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	expiring.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	if cause != ErrLockLost {
+		t.Errorf("expected ErrLockLost after validity, got %v", cause)
+	}
+
+	// Большинство узлов недоступно — 503, handler без блокировки не выполняется
+	servers[0].Close()
+	servers[1].Close()
+	called := false
+	down := RedlockMiddleware(rl, Options{Key: "lock:redlock:down", TTLMS: 1000})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	w = httptest.NewRecorder()
+	down.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusServiceUnavailable || called {
+		t.Errorf("expected 503 without quorum, got %d (handler called: %v)", w.Code, called)
+	}
+}
@@ -0,0 +1,245 @@
+package distributedlock
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisNow — текущее время сервера Redis в мс (локальная now). Сроки аренд в ZSET считаются
+// по часам Redis, а не экземпляра: экземпляр с убежавшими вперёд часами иначе выселял бы
+// чужие действующие аренды как истёкшие.
+const redisNow = `
+local clock = redis.call("TIME")
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+`
+
+var (
+	// KEYS[1] — ключ писателя, KEYS[2] — ZSET читателей (токен → срок аренды в мс),
+	// KEYS[3] — отметка ожидающего писателя.
+	// ARGV[1] — токен владельца, ARGV[2] — TTL в мс.
+	// Читатель не входит, пока блокировку держит или ждёт писатель.
+	readLockScript = redis.NewScript(redisNow + `
+if redis.call("EXISTS", KEYS[1]) == 1 or redis.call("EXISTS", KEYS[3]) == 1 then
+    return 0
+end
+local ttl = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", now)
+redis.call("ZADD", KEYS[2], now + ttl, ARGV[1])
+if redis.call("PTTL", KEYS[2]) < ttl then
+    redis.call("PEXPIRE", KEYS[2], ttl)
+end
+return 1
+`)
+
+	// KEYS — как у readLockScript. ARGV[1..2] — как у readLockScript,
+	// ARGV[3] — на сколько мс отметить ожидание писателя, если мешают читатели (0 — не отмечать).
+	// Истёкшие аренды читателей не мешают захвату.
+	writeLockScript = redis.NewScript(redisNow + `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+    return 0
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", now)
+if redis.call("ZCARD", KEYS[2]) > 0 then
+    if tonumber(ARGV[3]) > 0 then
+        redis.call("SET", KEYS[3], ARGV[1], "PX", ARGV[3])
+    end
+    return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+if redis.call("GET", KEYS[3]) == ARGV[1] then
+    redis.call("DEL", KEYS[3])
+end
+return 1
+`)
+
+	// KEYS[1] — ZSET держателей семафора (токен → срок аренды в мс).
+	// ARGV[1] — токен владельца, ARGV[2] — TTL в мс, ARGV[3] — число мест.
+	semaphoreScript = redis.NewScript(redisNow + `
+local ttl = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+    return 0
+end
+redis.call("ZADD", KEYS[1], now + ttl, ARGV[1])
+if redis.call("PTTL", KEYS[1]) < ttl then
+    redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 1
+`)
+
+	// Продлеваем аренду участника ZSET (читателя или держателя семафора), если она ещё наша.
+	// ARGV[1] — токен, ARGV[2] — TTL в мс.
+	renewMemberScript = redis.NewScript(redisNow + `
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+    return 0
+end
+local ttl = tonumber(ARGV[2])
+redis.call("ZADD", KEYS[1], now + ttl, ARGV[1])
+if redis.call("PTTL", KEYS[1]) < ttl then
+    redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 1
+`)
+
+	// Удаляем ключ, только если в нём записан ARGV[1].
+	deleteIfOwnerScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+	// Убираем участника ZSET и будим ожидающих через канал ARGV[2].
+	releaseMemberScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 1 then
+    redis.call("PUBLISH", ARGV[2], "released")
+    return 1
+end
+return 0
+`)
+)
+
+func writerKey(key string) string {
+	return key + ":write"
+}
+
+func readersKey(key string) string {
+	return key + ":readers"
+}
+
+func writerPendingKey(key string) string {
+	return key + ":write:pending"
+}
+
+func holdersKey(key string) string {
+	return key + ":holders"
+}
+
+// isReadMethod сообщает, что метод только читает ресурс и может разделять блокировку.
+func isReadMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// RWLockMiddleware — блокировка чтения/записи, режим выбирается по методу запроса:
+// GET, HEAD и OPTIONS берут разделяемую блокировку (читателей может быть сколько угодно),
+// остальные методы — исключительную. Пока писатель ждёт освобождения ресурса
+// (WaitTimeout > 0), новые читатели не входят, чтобы поток чтений не блокировал запись навсегда.
+// Поддерживаются Key/KeyFunc, TTLMS, HoldUntilTTL, DisableRenewal и WaitTimeout.
+func RWLockMiddleware(opts Options) func(http.Handler) http.Handler {
+	readLease := lease{
+		acquire: func(ctx context.Context, key, owner string) (time.Duration, bool, error) {
+			return withTTL(acquireLease(ctx, key, opts.WaitTimeout, func() (bool, error) {
+				return runLockScript(readLockScript, []string{writerKey(key), readersKey(key), writerPendingKey(key)},
+					owner, opts.TTLMS)
+			}))
+		},
+		release: func(ctx context.Context, key, owner string) {
+			releaseMember(ctx, readersKey(key), key, owner)
+		},
+		renew: func(key, owner string) (time.Duration, bool, error) {
+			return withTTL(renewMember(readersKey(key), owner, opts.TTLMS))
+		},
+	}
+
+	writeLease := lease{
+		acquire: func(ctx context.Context, key, owner string) (time.Duration, bool, error) {
+			// Отметка ожидания живёт недолго: если писатель ушёл, читатели не ждут её дольше необходимого
+			pendingMS := int64(0)
+			if opts.WaitTimeout > 0 {
+				pendingMS = (3 * waitPollInterval).Milliseconds()
+				defer func() {
+					deleteIfOwner(writerPendingKey(key), owner)
+				}()
+			}
+			return withTTL(acquireLease(ctx, key, opts.WaitTimeout, func() (bool, error) {
+				return runLockScript(writeLockScript, []string{writerKey(key), readersKey(key), writerPendingKey(key)},
+					owner, opts.TTLMS, pendingMS)
+			}))
+		},
+		release: func(ctx context.Context, key, owner string) {
+			release(ctx, writerKey(key), key, owner)
+		},
+		renew: func(key, owner string) (time.Duration, bool, error) {
+			return withTTL(renew(ctxLock, redisClientLock, writerKey(key), owner, opts.TTLMS))
+		},
+	}
+
+	return leaseMiddleware(opts, func(r *http.Request) lease {
+		if isReadMethod(r.Method) {
+			return readLease
+		}
+		return writeLease
+	})
+}
+
+// SemaphoreMiddleware пропускает к ресурсу не более limit запросов одновременно
+// (распределённый счётный семафор). Каждое место — аренда с TTL, поэтому места
+// упавших экземпляров освобождаются сами. Настройки — как у RedisLockMiddlewareWithOptions,
+// кроме Fair.
+func SemaphoreMiddleware(limit int, opts Options) func(http.Handler) http.Handler {
+	l := lease{
+		acquire: func(ctx context.Context, key, owner string) (time.Duration, bool, error) {
+			return withTTL(acquireLease(ctx, key, opts.WaitTimeout, func() (bool, error) {
+				return runLockScript(semaphoreScript, []string{holdersKey(key)},
+					owner, opts.TTLMS, limit)
+			}))
+		},
+		release: func(ctx context.Context, key, owner string) {
+			releaseMember(ctx, holdersKey(key), key, owner)
+		},
+		renew: func(key, owner string) (time.Duration, bool, error) {
+			return withTTL(renewMember(holdersKey(key), owner, opts.TTLMS))
+		},
+	}
+	return leaseMiddleware(opts, func(r *http.Request) lease { return l })
+}
+
+// acquireLease делает одну попытку try или, с waitTimeout, ждёт через waitFor.
+func acquireLease(ctx context.Context, key string, waitTimeout time.Duration, try func() (bool, error)) (bool, error) {
+	if waitTimeout <= 0 {
+		return try()
+	}
+	return waitFor(ctx, key, waitTimeout, func() (bool, time.Duration, error) {
+		acquired, err := try()
+		return acquired, 0, err
+	})
+}
+
+// withTTL — результат захвата или продления, время действия которого ограничено только TTL.
+func withTTL(ok bool, err error) (time.Duration, bool, error) {
+	return 0, ok, err
+}
+
+// runLockScript выполняет скрипт захвата, возвращающий 1 или 0.
+func runLockScript(script *redis.Script, keys []string, args ...interface{}) (bool, error) {
+	res, err := script.Run(ctxLock, redisClientLock, keys, args...).Result()
+	if err != nil {
+		return false, err
+	}
+	acquired, ok := res.(int64)
+	return ok && acquired == 1, nil
+}
+
+func renewMember(setKey, owner string, ttlMS int64) (bool, error) {
+	return runLockScript(renewMemberScript, []string{setKey}, owner, ttlMS)
+}
+
+// releaseMember убирает owner из ZSET setKey и будит ожидающих блокировку key.
+func releaseMember(ctx context.Context, setKey, key, owner string) {
+	released, err := runLockScript(releaseMemberScript, []string{setKey}, owner, releasedChannel(key))
+	if err == nil && released {
+		lockReleased.Add(ctx, 1)
+	}
+}
+
+// deleteIfOwner удаляет ключ, если в нём всё ещё записан owner.
+func deleteIfOwner(key, owner string) {
+	deleteIfOwnerScript.Run(ctxLock, redisClientLock, []string{key}, owner)
+}
@@ -0,0 +1,161 @@
+package distributedlock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRWLockMiddleware(t *testing.T) {
+	if err := InitRedisLock("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	lockKey := "lock:rw:test"
+	redisClientLock.Del(ctxLock, writerKey(lockKey), readersKey(lockKey), writerPendingKey(lockKey))
+
+	// Вложенный запрос выполняется, пока внешний держит блокировку
+	var nested int
+	var handler http.Handler
+	handler = RWLockMiddleware(Options{Key: lockKey, TTLMS: 1000})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if method := r.URL.Query().Get("nested"); method != "" {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(method, "/", nil))
+			nested = rec.Code
+		}
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	cases := []struct {
+		outer, inner string
+		want         int
+	}{
+		{http.MethodGet, http.MethodGet, http.StatusOK},               // читатели разделяют блокировку
+		{http.MethodGet, http.MethodPost, http.StatusTooManyRequests}, // писатель ждёт читателей
+		{http.MethodPut, http.MethodGet, http.StatusTooManyRequests},  // читатель ждёт писателя
+		{http.MethodPut, http.MethodPut, http.StatusTooManyRequests},  // запись исключительна
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(c.outer, "/?nested="+c.inner, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", c.outer, w.Code)
+		}
+		if nested != c.want {
+			t.Errorf("%s inside %s: expected %d, got %d", c.inner, c.outer, c.want, nested)
+		}
+	}
+
+	// После всех запросов ни писателя, ни читателей не осталось
+	if n, _ := redisClientLock.Exists(ctxLock, writerKey(lockKey)).Result(); n != 0 {
+		t.Errorf("expected write lock to be released")
+	}
+	if n, _ := redisClientLock.ZCard(ctxLock, readersKey(lockKey)).Result(); n != 0 {
+		t.Errorf("expected no readers, got %d", n)
+	}
+}
+
+func TestRWLockWriterPreference(t *testing.T) {
+	if err := InitRedisLock("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	lockKey := "lock:rw:writer"
+	redisClientLock.Del(ctxLock, writerKey(lockKey), readersKey(lockKey), writerPendingKey(lockKey))
+
+	readerIn := make(chan struct{})
+	readerDone := make(chan struct{})
+	reader := RWLockMiddleware(Options{Key: lockKey, TTLMS: 2000})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(readerIn)
+		<-readerDone
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	writer := RWLockMiddleware(Options{Key: lockKey, TTLMS: 2000, WaitTimeout: 3 * time.Second})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	go reader.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	<-readerIn
+
+	writerCode := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		writer.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		writerCode <- w.Code
+	}()
+
+	// Пока писатель ждёт, новые читатели не входят
+	time.Sleep(100 * time.Millisecond)
+	probe := RWLockMiddleware(Options{Key: lockKey, TTLMS: 2000})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	w := httptest.NewRecorder()
+	probe.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for reader while writer waits, got %d", w.Code)
+	}
+
+	// Последний читатель вышел — писатель получает блокировку
+	close(readerDone)
+	select {
+	case code := <-writerCode:
+		if code != http.StatusOK {
+			t.Errorf("expected writer to get 200, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer did not finish")
+	}
+}
+
+func TestSemaphoreMiddleware(t *testing.T) {
+	if err := InitRedisLock("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	lockKey := "lock:semaphore:test"
+	redisClientLock.Del(ctxLock, holdersKey(lockKey))
+
+	// Каждый запрос держит место и делает вложенный запрос, пока depth > 0
+	codes := map[int]int{}
+	var handler http.Handler
+	handler = SemaphoreMiddleware(2, Options{Key: lockKey, TTLMS: 1000})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		depth, _ := strconv.Atoi(r.URL.Query().Get("depth"))
+		if depth > 0 {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?depth="+strconv.Itoa(depth-1), nil))
+			codes[depth-1] = rec.Code
+		}
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?depth=2", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 for first holder, got %d", w.Code)
+	}
+	if codes[1] != http.StatusOK {
+		t.Errorf("expected 200 for second holder, got %d", codes[1])
+	}
+	if codes[0] != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for third request, got %d", codes[0])
+	}
+
+	// Места освобождены
+	if n, _ := redisClientLock.ZCard(ctxLock, holdersKey(lockKey)).Result(); n != 0 {
+		t.Errorf("expected no holders, got %d", n)
+	}
+
+	// Место упавшего держателя освобождается по истечении аренды
+	// (сроки аренд считаются по часам Redis)
+	now := redisClientLock.Time(ctxLock).Val()
+	for _, owner := range []string{"dead-1", "dead-2"} {
+		redisClientLock.ZAdd(ctxLock, holdersKey(lockKey), &redis.Z{Score: float64(now.Add(-time.Second).UnixMilli()), Member: owner})
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected expired holders to be evicted, got %d", w.Code)
+	}
+}
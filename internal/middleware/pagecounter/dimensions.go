@@ -0,0 +1,443 @@
+package pagecounter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+// Dimension — измерение, по которому раскладываются просмотры.
+type Dimension string
+
+const (
+	// DimRoute — шаблон маршрута ServeMux (r.Pattern), например "GET /items/{id}".
+	DimRoute Dimension = "route"
+	// DimPath — путь запроса.
+	DimPath Dimension = "path"
+	// DimMethod — HTTP метод.
+	DimMethod Dimension = "method"
+	// DimTenant — арендатор (Options.Tenant, по умолчанию заголовок X-Tenant-ID).
+	DimTenant Dimension = "tenant"
+	// DimReferrer — хост из заголовка Referer.
+	DimReferrer Dimension = "referrer"
+)
+
+const (
+	// defaultMaxCardinality — сколько различных значений измерения учитывается по умолчанию.
+	defaultMaxCardinality = 1000
+	// defaultMaxCombinations — сколько различных комбинаций учитывается по умолчанию.
+	defaultMaxCombinations = 10000
+	// defaultValuesRetention — сколько по умолчанию помнить известные значения измерений.
+	defaultValuesRetention = 30 * 24 * time.Hour
+	// scanBatch — сколько полей HASH читать за один HSCAN.
+	scanBatch = 1000
+	// defaultCombinationsLimit и maxCombinationsLimit — размер ответа CountsHandler
+	// без ?limit и наибольший допустимый ?limit.
+	defaultCombinationsLimit = 100
+	maxCombinationsLimit     = 1000
+	// emptyValue — значение измерения, которого нет в запросе.
+	emptyValue = "-"
+)
+
+// OtherValue — значение измерения, под которым считаются значения сверх MaxCardinality
+// (и все измерения комбинаций сверх MaxCombinations). В Redis значения хранятся
+// экранированными (url.QueryEscape всегда экранирует скобки), поэтому настоящее значение
+// "(other)" с ним не сливается: в ответах оно показывается экранированным, "%28other%29".
+const OtherValue = "(other)"
+
+var (
+	// KEYS[1] — HASH комбинаций, KEYS[2..n+1] — HASH счётчиков по каждому измерению,
+	// KEYS[n+2..2n+1] — SET известных значений каждого измерения.
+	// ARGV[1] — TTL счётчиков в секундах (0 — без TTL), ARGV[2] — предел числа значений измерения,
+	// ARGV[3] — предел числа комбинаций, ARGV[4] — TTL множеств значений в секундах,
+	// ARGV[5] — OtherValue, далее по два аргумента на измерение: имя и экранированное значение.
+	// Новое значение сверх предела считается как OtherValue, новая комбинация сверх предела —
+	// как комбинация, где все измерения OtherValue. Возвращает счётчик комбинации и её поле в HASH.
+	dimensionScript = redis.NewScript(`
+local n = (#KEYS - 1) / 2
+local max = tonumber(ARGV[2])
+local parts, others = {}, {}
+for i = 1, n do
+    local name, value = ARGV[2 * i + 4], ARGV[2 * i + 5]
+    local values = KEYS[1 + n + i]
+    if redis.call("SISMEMBER", values, value) == 0 then
+        if redis.call("SCARD", values) >= max then
+            value = ARGV[5]
+        else
+            redis.call("SADD", values, value)
+        end
+    end
+    if redis.call("TTL", values) == -1 then
+        redis.call("EXPIRE", values, ARGV[4])
+    end
+    redis.call("HINCRBY", KEYS[1 + i], value, 1)
+    table.insert(parts, name .. "=" .. value)
+    table.insert(others, name .. "=" .. ARGV[5])
+end
+local field = table.concat(parts, "&")
+if redis.call("HEXISTS", KEYS[1], field) == 0 and redis.call("HLEN", KEYS[1]) >= tonumber(ARGV[3]) then
+    field = table.concat(others, "&")
+end
+local count = redis.call("HINCRBY", KEYS[1], field, 1)
+if tonumber(ARGV[1]) > 0 then
+    for i = 1, n + 1 do
+        if redis.call("TTL", KEYS[i]) == -1 then
+            redis.call("EXPIRE", KEYS[i], ARGV[1])
+        end
+    end
+end
+return {count, field}
+`)
+)
+
+// Options — настройки CounterMiddlewareWithOptions.
+type Options struct {
+	// Prefix — префикс ключей счётчиков, например "counter:views".
+	Prefix string
+	// Dimensions — измерения, по которым раскладываются просмотры.
+	Dimensions []Dimension
+	// TTLSec — время жизни счётчиков с первого просмотра (0 — без TTL).
+	TTLSec int
+	// MaxCardinality — сколько различных значений каждого измерения учитывается;
+	// остальные считаются как OtherValue. 0 — defaultMaxCardinality.
+	MaxCardinality int
+	// MaxCombinations — сколько различных комбинаций значений учитывается; новые комбинации
+	// сверх предела считаются как комбинация, где все измерения OtherValue. 0 — defaultMaxCombinations.
+	MaxCombinations int
+	// ValuesRetention — сколько помнить известные значения измерений, по которым ограничивается
+	// кардинальность (отсчёт с первого значения). Не зависит от TTLSec: без TTL счётчиков
+	// множества всё равно обновляются. 0 — defaultValuesRetention.
+	ValuesRetention time.Duration
+	// Tenant — арендатор запроса для DimTenant. По умолчанию — заголовок X-Tenant-ID.
+	Tenant func(r *http.Request) string
+
+	// UniqueVisitors включает подсчёт уникальных посетителей (HyperLogLog по суткам, см. DailyUniques).
+	// Уникальные считаются на весь Prefix, без разбивки по страницам и измерениям.
+	UniqueVisitors bool
+	// Visitor — идентификатор посетителя. По умолчанию — пользователь или ID сессии,
+	// а без сессии — хэш IP и User-Agent.
+	Visitor func(r *http.Request) string
+	// UniquesRetention — сколько хранить дневные и недельные HyperLogLog (0 — 35 дней).
+	UniquesRetention time.Duration
+
+	// TimeSeries включает временной ряд просмотров: минутные бакеты, которые Rollup
+	// сворачивает в часовые и дневные (см. Series). Просмотры за период даёт ряд, поэтому
+	// TTLSec вместе с TimeSeries обычно не задают: счётчики считаются за всё время.
+	TimeSeries bool
+	// MinuteRetention, HourRetention, DayRetention — хранение бакетов каждого разрешения
+	// (0 — 48 часов, 90 дней и 2 года соответственно).
+	MinuteRetention time.Duration
+	HourRetention   time.Duration
+	DayRetention    time.Duration
+}
+
+func (opts Options) maxCardinality() int {
+	if opts.MaxCardinality > 0 {
+		return opts.MaxCardinality
+	}
+	return defaultMaxCardinality
+}
+
+func (opts Options) maxCombinations() int {
+	if opts.MaxCombinations > 0 {
+		return opts.MaxCombinations
+	}
+	return defaultMaxCombinations
+}
+
+func (opts Options) valuesRetention() time.Duration {
+	if opts.ValuesRetention > 0 {
+		return opts.ValuesRetention
+	}
+	return defaultValuesRetention
+}
+
+// combinationsKey — HASH "route=...&method=..." -> просмотры.
+func (opts Options) combinationsKey() string {
+	return opts.Prefix
+}
+
+// dimensionKey — HASH значение измерения -> просмотры.
+func (opts Options) dimensionKey(d Dimension) string {
+	return opts.Prefix + ":by:" + string(d)
+}
+
+// valuesKey — SET известных значений измерения (для ограничения кардинальности).
+func (opts Options) valuesKey(d Dimension) string {
+	return opts.Prefix + ":values:" + string(d)
+}
+
+func (opts Options) hasDimension(d Dimension) bool {
+	for _, dim := range opts.Dimensions {
+		if dim == d {
+			return true
+		}
+	}
+	return false
+}
+
+// dimensionValue извлекает значение измерения из запроса.
+func (opts Options) dimensionValue(r *http.Request, d Dimension) string {
+	var v string
+	switch d {
+	case DimRoute:
+		v = r.Pattern
+	case DimPath:
+		v = r.URL.Path
+	case DimMethod:
+		v = r.Method
+	case DimTenant:
+		if opts.Tenant != nil {
+			v = opts.Tenant(r)
+		} else {
+			v = r.Header.Get("X-Tenant-ID")
+		}
+	case DimReferrer:
+		if ref, err := url.Parse(r.Referer()); err == nil {
+			v = ref.Hostname()
+		}
+	}
+	if v == "" {
+		return emptyValue
+	}
+	return v
+}
+
+// CounterMiddlewareWithOptions считает просмотры в разрезе измерений opts.Dimensions:
+// по каждой комбинации значений (HASH opts.Prefix) и по каждому измерению отдельно
+// (HASH <Prefix>:by:<dimension>). Число различных значений измерения ограничено
+// MaxCardinality, число комбинаций — MaxCombinations, остальное считается как OtherValue.
+// Всё — одним Lua скриптом.
+// Счётчик комбинации текущего запроса — в заголовке X-Counter.
+// С UniqueVisitors посетитель также добавляется в HyperLogLog текущих суток,
+// с TimeSeries — просмотр учитывается в минутных бакетах общего ряда и ряда комбинации.
+func CounterMiddlewareWithOptions(opts Options) func(http.Handler) http.Handler {
+	if opts.UniqueVisitors {
+		registerUniques(opts.Prefix)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			defer func() {
+				pageDuration.Record(r.Context(), time.Since(start).Seconds())
+			}()
+
+			n := len(opts.Dimensions)
+			keys := make([]string, 1, 1+2*n)
+			keys[0] = opts.combinationsKey()
+			args := []interface{}{opts.TTLSec, opts.maxCardinality(), opts.maxCombinations(),
+				int64(opts.valuesRetention() / time.Second), OtherValue}
+			for _, d := range opts.Dimensions {
+				keys = append(keys, opts.dimensionKey(d))
+				args = append(args, string(d), url.QueryEscape(opts.dimensionValue(r, d)))
+			}
+			for _, d := range opts.Dimensions {
+				keys = append(keys, opts.valuesKey(d))
+			}
+
+			if opts.UniqueVisitors {
+				// Ошибка учёта посетителя не мешает ни счётчику, ни запросу
+				_ = addVisitor(opts, r)
+			}
+			res, err := dimensionScript.Run(ctxCounter, redisClientCounter, keys, args...).Slice()
+			if err != nil || len(res) != 2 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			count, _ := res[0].(int64)
+			if opts.TimeSeries {
+				// Ряд ведётся по той же комбинации, что и счётчик (с учётом OtherValue)
+				field, _ := res[1].(string)
+				_ = addToSeries(opts, field, time.Now())
+			}
+
+			w.Header().Set("X-Counter", strconv.FormatInt(count, 10))
+			pageCounter.Add(r.Context(), 1)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CountsBy возвращает просмотры по значениям измерения d (значения — как их показывает displayValue).
+func CountsBy(ctx context.Context, opts Options, d Dimension) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	err := scanCounts(opts.dimensionKey(d), func(field string, n int64) {
+		counts[displayValue(field)] += n
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// displayValue — значение измерения для ответа: OtherValue как есть, остальные — без
+// экранирования. Настоящее значение, совпадающее с OtherValue (или не разбираемое),
+// остаётся экранированным, чтобы его нельзя было спутать с вытесненными.
+func displayValue(escaped string) string {
+	if escaped == OtherValue {
+		return OtherValue
+	}
+	v, err := url.QueryUnescape(escaped)
+	if err != nil || v == OtherValue {
+		return escaped
+	}
+	return v
+}
+
+// escapeValue — значение измерения из запроса в том виде, в каком оно хранится в Redis.
+func escapeValue(v string) string {
+	if v == OtherValue {
+		return OtherValue
+	}
+	return url.QueryEscape(v)
+}
+
+// Combination — просмотры одной комбинации значений измерений.
+type Combination struct {
+	Dimensions map[string]string `json:"dimensions"`
+	Count      int64             `json:"count"`
+}
+
+// Combinations возвращает до limit (0 — без ограничения) самых популярных комбинаций,
+// у которых значения измерений совпадают с filter (пустой filter — все).
+// HASH читается постранично через HSCAN, в памяти держится не больше 2*limit комбинаций.
+func Combinations(ctx context.Context, opts Options, filter map[Dimension]string, limit int) ([]Combination, error) {
+	var result []Combination
+	top := func() {
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].Count > result[j].Count
+		})
+		if limit > 0 && len(result) > limit {
+			result = result[:limit]
+		}
+	}
+	err := scanCounts(opts.combinationsKey(), func(field string, count int64) {
+		c := Combination{Dimensions: make(map[string]string), Count: count}
+		if field != "" {
+			for _, part := range strings.Split(field, "&") {
+				name, value, _ := strings.Cut(part, "=")
+				c.Dimensions[name] = displayValue(value)
+			}
+		}
+		matched := true
+		for d, v := range filter {
+			if c.Dimensions[string(d)] != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result = append(result, c)
+			if limit > 0 && len(result) >= 2*limit {
+				top()
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	top()
+	if result == nil {
+		result = []Combination{}
+	}
+	return result, nil
+}
+
+func hashCounts(key string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	err := scanCounts(key, func(field string, n int64) {
+		counts[field] = n
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// scanCounts обходит HASH счётчиков key через HSCAN по scanBatch полей,
+// не блокируя Redis чтением всего HASH разом.
+func scanCounts(key string, fn func(field string, n int64)) error {
+	var cursor uint64
+	for {
+		fields, next, err := redisClientCounter.HScan(ctxCounter, key, cursor, "", scanBatch).Result()
+		if err != nil {
+			return err
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			n, err := strconv.ParseInt(fields[i+1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid counter %s[%s]: %w", key, fields[i], err)
+			}
+			fn(fields[i], n)
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// CountsHandler — endpoint чтения счётчиков.
+// ?by=<dimension> — просмотры по значениям измерения: {"dimension", "counts", "total"}.
+// Без by — комбинации от самых популярных: {"combinations": [...]}; параметры
+// с именами измерений (?route=...&method=GET) фильтруют комбинации, limit ограничивает ответ
+// (по умолчанию defaultCombinationsLimit, не больше maxCombinationsLimit).
+func CountsHandler(opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			utils.JSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		query := r.URL.Query()
+
+		if by := Dimension(query.Get("by")); by != "" {
+			if !opts.hasDimension(by) {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "unknown dimension"})
+				return
+			}
+			counts, err := CountsBy(r.Context(), opts, by)
+			if err != nil {
+				utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to read counters"})
+				return
+			}
+			total := int64(0)
+			for _, n := range counts {
+				total += n
+			}
+			utils.JSON(w, http.StatusOK, map[string]interface{}{"dimension": by, "counts": counts, "total": total})
+			return
+		}
+
+		filter := make(map[Dimension]string)
+		for _, d := range opts.Dimensions {
+			if v := query.Get(string(d)); v != "" {
+				filter[d] = v
+			}
+		}
+		limit := defaultCombinationsLimit
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxCombinationsLimit {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+				return
+			}
+			limit = n
+		}
+		combinations, err := Combinations(r.Context(), opts, filter, limit)
+		if err != nil {
+			utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to read counters"})
+			return
+		}
+		utils.JSON(w, http.StatusOK, map[string]interface{}{"combinations": combinations})
+	})
+}
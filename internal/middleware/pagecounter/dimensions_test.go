@@ -0,0 +1,135 @@
+package pagecounter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+)
+
+func TestCounterDimensions(t *testing.T) {
+	if err := InitRedisCounter("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := Options{
+		Prefix:          "counter:test:dims",
+		Dimensions:      []Dimension{DimRoute, DimMethod, DimPath, DimReferrer},
+		MaxCardinality:  2,
+		MaxCombinations: 3,
+	}
+	keys := []string{opts.combinationsKey()}
+	for _, d := range opts.Dimensions {
+		keys = append(keys, opts.dimensionKey(d), opts.valuesKey(d))
+	}
+	redisClientCounter.Del(ctxCounter, keys...)
+	defer redisClientCounter.Del(ctxCounter, keys...)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /items/{id}", CounterMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})))
+	mux.Handle("GET /stats", CountsHandler(opts))
+	view := func(path, referer string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Header().Get("X-Counter")
+	}
+
+	// 1. Счётчик комбинации растёт только для одинаковых значений измерений
+	if c := view("/items/1", "https://google.com/search?q=x"); c != "1" {
+		t.Errorf("expected counter 1, got %s", c)
+	}
+	if c := view("/items/1", "https://google.com/"); c != "2" {
+		t.Errorf("expected counter 2, got %s", c)
+	}
+	view("/items/2", "")
+	// Третий путь сверх MaxCardinality считается как OtherValue
+	view("/items/3", "")
+	view("/items/4", "")
+
+	stats := func(query string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats"+query, nil))
+		resp := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// 2. Просмотры по измерениям
+	byPath := stats("?by=path")
+	counts, _ := byPath["counts"].(map[string]interface{})
+	if counts["/items/1"] != 2.0 || counts["/items/2"] != 1.0 || counts[OtherValue] != 2.0 || byPath["total"] != 5.0 {
+		t.Errorf("unexpected counts by path: %v", byPath)
+	}
+	byRoute := stats("?by=route")
+	if counts, _ := byRoute["counts"].(map[string]interface{}); counts["GET /items/{id}"] != 5.0 {
+		t.Errorf("unexpected counts by route: %v", byRoute)
+	}
+	byReferrer := stats("?by=referrer")
+	if counts, _ := byReferrer["counts"].(map[string]interface{}); counts["google.com"] != 2.0 || counts["-"] != 3.0 {
+		t.Errorf("unexpected counts by referrer: %v", byReferrer)
+	}
+
+	// 3. Комбинации с фильтром
+	combos, _ := stats("?referrer=google.com")["combinations"].([]interface{})
+	if len(combos) != 1 {
+		t.Fatalf("expected one combination for google.com, got %v", combos)
+	}
+	if c, _ := combos[0].(map[string]interface{}); c["count"] != 2.0 {
+		t.Errorf("expected combination count 2, got %v", c)
+	}
+	if resp := stats("?by=unknown"); resp["error"] == nil {
+		t.Errorf("expected error for unknown dimension, got %v", resp)
+	}
+	if combos, _ := stats("?limit=1")["combinations"].([]interface{}); len(combos) != 1 {
+		t.Errorf("expected one combination with limit=1, got %v", combos)
+	}
+
+	// 4. Новая комбинация сверх MaxCombinations считается как комбинация OtherValue
+	view("/items/1", "")
+	combos, _ = stats("?route=" + url.QueryEscape(OtherValue) + "&path=" + url.QueryEscape(OtherValue))["combinations"].([]interface{})
+	if len(combos) != 1 {
+		t.Fatalf("expected overflow combination, got %v", combos)
+	}
+	if c, _ := combos[0].(map[string]interface{}); c["count"] != 1.0 {
+		t.Errorf("expected overflow combination count 1, got %v", c)
+	}
+	if n := redisClientCounter.HLen(ctxCounter, opts.combinationsKey()).Val(); n != 4 {
+		t.Errorf("expected 3 combinations plus overflow, got %d", n)
+	}
+
+	// 5. Множества значений живут своё время, даже когда у счётчиков TTL нет
+	if ttl := redisClientCounter.TTL(ctxCounter, opts.valuesKey(DimPath)).Val(); ttl <= 0 {
+		t.Errorf("expected values set to have retention, got %v", ttl)
+	}
+
+	// 6. Настоящие значения "other" и "(other)" не сливаются с вытесненными
+	tenants := Options{Prefix: "counter:test:dims:other", Dimensions: []Dimension{DimTenant}, MaxCardinality: 2}
+	tenantKeys := []string{tenants.combinationsKey(), tenants.dimensionKey(DimTenant), tenants.valuesKey(DimTenant)}
+	redisClientCounter.Del(ctxCounter, tenantKeys...)
+	defer redisClientCounter.Del(ctxCounter, tenantKeys...)
+	tenantHandler := CounterMiddlewareWithOptions(tenants)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tenant := range []string{"other", OtherValue, "a", "b"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Tenant-ID", tenant)
+		tenantHandler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	byTenant, err := CountsBy(ctxCounter, tenants, DimTenant)
+	if err != nil {
+		t.Fatalf("CountsBy failed: %v", err)
+	}
+	if byTenant["other"] != 1 || byTenant[url.QueryEscape(OtherValue)] != 1 || byTenant[OtherValue] != 2 {
+		t.Errorf("expected real values apart from overflow, got %v", byTenant)
+	}
+	overflow, err := Combinations(ctxCounter, tenants, map[Dimension]string{DimTenant: OtherValue}, 0)
+	if err != nil || len(overflow) != 1 || overflow[0].Count != 2 {
+		t.Errorf("expected overflow combination with count 2, got %v (%v)", overflow, err)
+	}
+}
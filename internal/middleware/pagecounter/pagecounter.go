@@ -49,7 +49,9 @@ func CounterMiddleware(key string, ttlSec int) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
-			defer pageDuration.Record(r.Context(), time.Since(start).Seconds())
+			defer func() {
+				pageDuration.Record(r.Context(), time.Since(start).Seconds())
+			}()
 
 			res, err := counterScript.Run(ctxCounter, redisClientCounter, []string{key}, ttlSec).Result()
 			if err != nil {
@@ -0,0 +1,449 @@
+package pagecounter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+// Resolution — разрешение временного ряда.
+type Resolution string
+
+const (
+	ResMinute Resolution = "minute"
+	ResHour   Resolution = "hour"
+	ResDay    Resolution = "day"
+)
+
+const (
+	defaultMinuteRetention = 48 * time.Hour
+	defaultHourRetention   = 90 * 24 * time.Hour
+	defaultDayRetention    = 2 * 365 * 24 * time.Hour
+	// maxSeriesPoints — предел числа точек в ответе Series.
+	maxSeriesPoints = 2000
+	// rollupLease — на сколько берётся аренда свёртки; должна перекрывать время одного Rollup.
+	rollupLease = time.Minute
+)
+
+var (
+	// KEYS[1] — целевой бакет, KEYS[2..] — бакеты более мелкого разрешения за тот же период.
+	// ARGV[1] — TTL целевого бакета в секундах. Сумма записывается через SET, поэтому
+	// повторная свёртка того же периода безопасна. Возвращает сумму.
+	rollupScript = redis.NewScript(`
+local sum = 0
+for i = 2, #KEYS do
+    sum = sum + tonumber(redis.call("GET", KEYS[i]) or "0")
+end
+if sum > 0 then
+    redis.call("SET", KEYS[1], sum, "EX", ARGV[1])
+else
+    redis.call("DEL", KEYS[1])
+end
+return sum
+`)
+
+	// KEYS[1] — аренда свёртки. ARGV[1] — токен экземпляра. Снимает аренду, только если она
+	// всё ещё наша (после истечения её мог взять другой экземпляр).
+	releaseRollupScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+)
+
+// step — длительность бакета.
+func (res Resolution) step() time.Duration {
+	switch res {
+	case ResMinute:
+		return time.Minute
+	case ResHour:
+		return time.Hour
+	case ResDay:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// finer — разрешение, из которого сворачивается res ("" для минутного).
+func (res Resolution) finer() Resolution {
+	switch res {
+	case ResHour:
+		return ResMinute
+	case ResDay:
+		return ResHour
+	}
+	return ""
+}
+
+func (opts Options) retention(res Resolution) time.Duration {
+	var custom, def time.Duration
+	switch res {
+	case ResMinute:
+		custom, def = opts.MinuteRetention, defaultMinuteRetention
+	case ResHour:
+		custom, def = opts.HourRetention, defaultHourRetention
+	case ResDay:
+		custom, def = opts.DayRetention, defaultDayRetention
+	}
+	if custom > 0 {
+		return custom
+	}
+	return def
+}
+
+// bucketKey — бакет ряда series: <prefix>:ts:<resolution>:<начало бакета в unix-секундах>
+// для общего ряда (series == "") и <prefix>:ts:<series>:<resolution>:<unix> для ряда
+// комбинации измерений. Поле комбинации содержит "=" и не содержит ":" (значения
+// экранированы), поэтому ключи рядов не пересекаются.
+func (opts Options) bucketKey(res Resolution, series string, start time.Time) string {
+	key := opts.Prefix + ":ts:"
+	if series != "" {
+		key += series + ":"
+	}
+	return key + string(res) + ":" + strconv.FormatInt(start.Unix(), 10)
+}
+
+// changedKey — SET рядов (полей комбинаций, "" — общий ряд), у которых менялись бакеты
+// внутри периода разрешения res с началом start: <prefix>:ts:changed:<resolution>:<unix>.
+// Rollup сворачивает только эти ряды. Число рядов ограничено MaxCombinations.
+func (opts Options) changedKey(res Resolution, start time.Time) string {
+	return opts.Prefix + ":ts:changed:" + string(res) + ":" + strconv.FormatInt(start.Unix(), 10)
+}
+
+// rolledKey — начало последнего свёрнутого бакета разрешения res.
+func (opts Options) rolledKey(res Resolution) string {
+	return opts.Prefix + ":ts:rolled:" + string(res)
+}
+
+// rollupLeaseKey — аренда свёртки: пока она у одного экземпляра, остальные пропускают Rollup.
+func (opts Options) rollupLeaseKey() string {
+	return opts.Prefix + ":ts:rollup"
+}
+
+// bucketTTL — сколько бакету с началом start осталось жить при хранении retention.
+func bucketTTL(start time.Time, retention time.Duration, now time.Time) time.Duration {
+	ttl := start.Add(retention).Sub(now)
+	if ttl < time.Second {
+		return time.Second
+	}
+	return ttl
+}
+
+// addToSeries увеличивает минутные бакеты момента now: общего ряда и ряда комбинации
+// series (поле HASH комбинаций), и отмечает оба ряда изменёнными в часе now для Rollup.
+func addToSeries(opts Options, series string, now time.Time) error {
+	start := now.Truncate(time.Minute)
+	expireAt := start.Add(opts.retention(ResMinute))
+	hour := now.Truncate(time.Hour)
+	changed := opts.changedKey(ResHour, hour)
+	_, err := redisClientCounter.TxPipelined(ctxCounter, func(pipe redis.Pipeliner) error {
+		key := opts.bucketKey(ResMinute, "", start)
+		pipe.Incr(ctxCounter, key)
+		pipe.ExpireAt(ctxCounter, key, expireAt)
+		pipe.SAdd(ctxCounter, changed, "")
+		if series != "" {
+			key = opts.bucketKey(ResMinute, series, start)
+			pipe.Incr(ctxCounter, key)
+			pipe.ExpireAt(ctxCounter, key, expireAt)
+			pipe.SAdd(ctxCounter, changed, series)
+		}
+		pipe.ExpireAt(ctxCounter, changed, hour.Add(opts.retention(ResMinute)))
+		return nil
+	})
+	return err
+}
+
+// Rollup сворачивает минутные бакеты в часовые, а часовые — в дневные (сутки — по UTC).
+// Сворачиваются только завершённые периоды и только ряды, изменённые в них (changedKey):
+// на период — один конвейер скриптов. Текущий период Series досчитывает сам.
+// Запускать можно на каждом экземпляре: свёртку выполняет тот, кто взял аренду
+// rollupLeaseKey на rollupLease, остальные сразу возвращают nil.
+func Rollup(ctx context.Context, opts Options) error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(buf)
+	ok, err := redisClientCounter.SetNX(ctxCounter, opts.rollupLeaseKey(), token, rollupLease).Result()
+	if err != nil || !ok {
+		return err
+	}
+	defer releaseRollupScript.Run(ctxCounter, redisClientCounter, []string{opts.rollupLeaseKey()}, token)
+
+	now := time.Now()
+	if err := rollupLevel(opts, ResHour, now); err != nil {
+		return err
+	}
+	return rollupLevel(opts, ResDay, now)
+}
+
+// rollupLevel сворачивает бакеты разрешения dst.finer() в бакеты dst за завершённые периоды
+// после отметки rolledKey. Без отметки просматриваются периоды, за которые ещё хранятся
+// исходные бакеты, но читаются только их SET изменённых рядов — одним конвейером.
+func rollupLevel(opts Options, dst Resolution, now time.Time) error {
+	src := dst.finer()
+	step, srcStep := dst.step(), src.step()
+	current := now.Truncate(step)
+
+	start := now.Add(-opts.retention(src)).Truncate(step)
+	rolled, err := redisClientCounter.Get(ctxCounter, opts.rolledKey(dst)).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if err == nil {
+		if next := time.Unix(rolled, 0).Add(step); next.After(start) {
+			start = next
+		}
+	}
+	if !start.Before(current) {
+		return nil
+	}
+
+	var periods []time.Time
+	var changed []*redis.StringSliceCmd
+	_, err = redisClientCounter.Pipelined(ctxCounter, func(pipe redis.Pipeliner) error {
+		for period := start; period.Before(current); period = period.Add(step) {
+			periods = append(periods, period)
+			changed = append(changed, pipe.SMembers(ctxCounter, opts.changedKey(dst, period)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, period := range periods {
+		series := changed[i].Val()
+		if len(series) == 0 {
+			continue
+		}
+		ttl := int64(bucketTTL(period, opts.retention(dst), now).Seconds())
+		// Свёрнутый час меняет свои сутки: отмечаем ряды для уровня ResDay
+		var next string
+		if dst == ResHour {
+			next = opts.changedKey(ResDay, period.Truncate(ResDay.step()))
+		}
+		_, err := redisClientCounter.Pipelined(ctxCounter, func(pipe redis.Pipeliner) error {
+			for _, s := range series {
+				keys := []string{opts.bucketKey(dst, s, period)}
+				for t := period; t.Before(period.Add(step)); t = t.Add(srcStep) {
+					keys = append(keys, opts.bucketKey(src, s, t))
+				}
+				rollupScript.Eval(ctxCounter, pipe, keys, ttl)
+				if next != "" {
+					pipe.SAdd(ctxCounter, next, s)
+				}
+			}
+			if next != "" {
+				pipe.ExpireAt(ctxCounter, next, period.Truncate(ResDay.step()).Add(opts.retention(ResHour)))
+			}
+			pipe.Del(ctxCounter, opts.changedKey(dst, period))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return redisClientCounter.Set(ctxCounter, opts.rolledKey(dst), current.Add(-step).Unix(), opts.retention(src)).Err()
+}
+
+// StartRollup запускает Rollup каждые interval в фоне, пока не отменён ctx.
+func StartRollup(ctx context.Context, opts Options, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := Rollup(ctx, opts); err != nil {
+				log.Printf("pagecounter rollup: %v", err)
+			}
+		}
+	}()
+}
+
+// Point — точка временного ряда: начало бакета и число просмотров в нём.
+type Point struct {
+	Time  time.Time `json:"t"`
+	Count int64     `json:"count"`
+}
+
+// Series возвращает ряд разрешения res за [from, to]: по точке на каждый бакет, пустые — с нулём.
+// series — поле комбинации измерений (как в Combinations, см. SeriesFor), "" — все просмотры.
+// Часовые и дневные бакеты наполняются Rollup; текущий, ещё не свёрнутый час или день
+// считается суммой бакетов мельче.
+func Series(ctx context.Context, opts Options, series string, res Resolution, from, to time.Time) ([]Point, error) {
+	step := res.step()
+	if step == 0 {
+		return nil, fmt.Errorf("unknown resolution %q", res)
+	}
+	from, to = from.Truncate(step), to.Truncate(step)
+	if err := checkRange(step, from, to); err != nil {
+		return nil, err
+	}
+
+	var points []Point
+	var keys []string
+	for t := from; !t.After(to); t = t.Add(step) {
+		points = append(points, Point{Time: t.UTC()})
+		keys = append(keys, opts.bucketKey(res, series, t))
+	}
+	values, err := redisClientCounter.MGet(ctxCounter, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			points[i].Count, _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+
+	if src := res.finer(); src != "" {
+		current := time.Now().Truncate(step)
+		for i := range points {
+			if !points[i].Time.Equal(current) {
+				continue
+			}
+			open, err := Series(ctx, opts, series, src, current, current.Add(step-src.step()))
+			if err != nil {
+				return nil, err
+			}
+			points[i].Count = 0
+			for _, p := range open {
+				points[i].Count += p.Count
+			}
+		}
+	}
+	return points, nil
+}
+
+// checkRange проверяет усечённый до step диапазон [from, to] ряда.
+func checkRange(step time.Duration, from, to time.Time) error {
+	if to.Before(from) {
+		return fmt.Errorf("invalid range: from is after to")
+	}
+	if n := int(to.Sub(from)/step) + 1; n > maxSeriesPoints {
+		return fmt.Errorf("range too large: %d points, max %d", n, maxSeriesPoints)
+	}
+	return nil
+}
+
+// SeriesFor — ряд комбинации значений измерений для Series: значения задаются для всех
+// opts.Dimensions (отсутствующее в запросе значение — "-", вытесненное — OtherValue).
+// Строка совпадает с полем комбинации, которое пишет dimensionScript.
+func SeriesFor(opts Options, values map[Dimension]string) string {
+	parts := make([]string, 0, len(opts.Dimensions))
+	for _, d := range opts.Dimensions {
+		parts = append(parts, string(d)+"="+escapeValue(values[d]))
+	}
+	return strings.Join(parts, "&")
+}
+
+// SeriesHandler — endpoint временного ряда для дашборда.
+// Параметры: resolution (minute, hour, day; по умолчанию hour), from и to в RFC 3339.
+// По умолчанию to — текущий момент, from — 60 минут, 24 часа или 30 суток до него.
+// Параметры с именами измерений (?path=/a&method=GET) выбирают ряд комбинации: тогда
+// нужны значения всех измерений. Без них — ряд всех просмотров.
+// Ответ: {"resolution", "from", "to", "points": [{"t", "count"}], "total"},
+// для комбинации — ещё "dimensions".
+func SeriesHandler(opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			utils.JSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		query := r.URL.Query()
+
+		res := Resolution(query.Get("resolution"))
+		if res == "" {
+			res = ResHour
+		}
+		if res.step() == 0 {
+			utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "unknown resolution"})
+			return
+		}
+
+		to := time.Now()
+		if v := query.Get("to"); v != "" {
+			var err error
+			if to, err = time.Parse(time.RFC3339, v); err != nil {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid to"})
+				return
+			}
+		}
+		from := to.Add(-defaultSeriesWindow(res))
+		if v := query.Get("from"); v != "" {
+			var err error
+			if from, err = time.Parse(time.RFC3339, v); err != nil {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid from"})
+				return
+			}
+		}
+		// Тот же диапазон, что проверит Series: ошибка в нём — ошибка запроса, а не Redis
+		if err := checkRange(res.step(), from.Truncate(res.step()), to.Truncate(res.step())); err != nil {
+			utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid range"})
+			return
+		}
+
+		values := make(map[Dimension]string)
+		for _, d := range opts.Dimensions {
+			if v := query.Get(string(d)); v != "" {
+				values[d] = v
+			}
+		}
+		series := ""
+		if len(values) > 0 {
+			if len(values) != len(opts.Dimensions) {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "all dimensions required"})
+				return
+			}
+			series = SeriesFor(opts, values)
+		}
+
+		points, err := Series(r.Context(), opts, series, res, from, to)
+		if err != nil {
+			utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to read counters"})
+			return
+		}
+		total := int64(0)
+		for _, p := range points {
+			total += p.Count
+		}
+		resp := map[string]interface{}{
+			"resolution": res,
+			"from":       from.UTC().Format(time.RFC3339),
+			"to":         to.UTC().Format(time.RFC3339),
+			"points":     points,
+			"total":      total,
+		}
+		if series != "" {
+			resp["dimensions"] = values
+		}
+		utils.JSON(w, http.StatusOK, resp)
+	})
+}
+
+// defaultSeriesWindow — окно ряда по умолчанию: 60 точек минутного, 24 часового, 30 дневного.
+func defaultSeriesWindow(res Resolution) time.Duration {
+	switch res {
+	case ResMinute:
+		return time.Hour
+	case ResDay:
+		return 30 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
@@ -0,0 +1,175 @@
+package pagecounter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+)
+
+func TestTimeSeries(t *testing.T) {
+	if err := InitRedisCounter("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := Options{Prefix: "counter:test:ts", TimeSeries: true, MinuteRetention: 3 * time.Hour}
+	if keys, _ := redisClientCounter.Keys(ctxCounter, opts.Prefix+"*").Result(); len(keys) > 0 {
+		redisClientCounter.Del(ctxCounter, keys...)
+	}
+	defer func() {
+		if keys, _ := redisClientCounter.Keys(ctxCounter, opts.Prefix+"*").Result(); len(keys) > 0 {
+			redisClientCounter.Del(ctxCounter, keys...)
+		}
+	}()
+
+	handler := CounterMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/page", nil))
+	}
+
+	// Просмотры двухчасовой давности — минутные бакеты позапрошлого часа
+	now := time.Now()
+	past := now.Add(-2 * time.Hour).Truncate(time.Hour)
+	for i := 0; i < 4; i++ {
+		addToSeries(opts, "", past.Add(5*time.Minute))
+	}
+	addToSeries(opts, "", past.Add(59*time.Minute))
+
+	// 1. Минутный ряд — сразу после запроса
+	points, err := Series(context.Background(), opts, "", ResMinute, now.Add(-time.Minute), now)
+	if err != nil || len(points) != 2 || points[1].Count != 3 {
+		t.Fatalf("expected 3 views in current minute, got %+v %v", points, err)
+	}
+
+	// 2. Пока аренда свёртки у другого экземпляра, Rollup ничего не делает
+	redisClientCounter.Set(ctxCounter, opts.rollupLeaseKey(), "other-instance", time.Minute)
+	if err := Rollup(context.Background(), opts); err != nil {
+		t.Fatalf("rollup failed: %v", err)
+	}
+	if v, _ := redisClientCounter.Get(ctxCounter, opts.bucketKey(ResHour, "", past)).Int64(); v != 0 {
+		t.Errorf("expected no rollup without lease, got %d", v)
+	}
+	if lease := redisClientCounter.Get(ctxCounter, opts.rollupLeaseKey()).Val(); lease != "other-instance" {
+		t.Errorf("expected foreign lease to stay, got %q", lease)
+	}
+	redisClientCounter.Del(ctxCounter, opts.rollupLeaseKey())
+
+	// 3. Свёртка (дважды — результат тот же) наполняет часовые и дневные бакеты завершённых
+	// периодов, текущий час Series считает по минутам
+	for i := 0; i < 2; i++ {
+		if err := Rollup(context.Background(), opts); err != nil {
+			t.Fatalf("rollup failed: %v", err)
+		}
+	}
+	hours, _ := Series(context.Background(), opts, "", ResHour, past, now)
+	if len(hours) != 3 || hours[0].Count != 5 || hours[1].Count != 0 || hours[2].Count != 3 {
+		t.Errorf("unexpected hourly series: %+v", hours)
+	}
+	if rolled, _ := redisClientCounter.Get(ctxCounter, opts.rolledKey(ResHour)).Int64(); rolled != now.Truncate(time.Hour).Add(-time.Hour).Unix() {
+		t.Errorf("expected rollup mark at previous hour, got %d", rolled)
+	}
+	if v, _ := redisClientCounter.Get(ctxCounter, opts.bucketKey(ResHour, "", now.Truncate(time.Hour))).Int64(); v != 0 {
+		t.Errorf("expected current hour not to be rolled, got %d", v)
+	}
+	if n := redisClientCounter.Exists(ctxCounter, opts.changedKey(ResHour, past)).Val(); n != 0 {
+		t.Errorf("expected changed series of rolled hour to be cleared")
+	}
+	if redisClientCounter.Exists(ctxCounter, opts.rollupLeaseKey()).Val() != 0 {
+		t.Errorf("expected rollup lease to be released")
+	}
+	days, _ := Series(context.Background(), opts, "", ResDay, past, now)
+	total := int64(0)
+	for _, p := range days {
+		total += p.Count
+	}
+	if total != 8 {
+		t.Errorf("expected 8 views in daily series, got %+v", days)
+	}
+
+	// 4. Endpoint
+	w := httptest.NewRecorder()
+	SeriesHandler(opts).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/series?resolution=hour", nil))
+	resp := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp["total"] != 8.0 {
+		t.Errorf("expected total 8 over last 24 hours, got %d %v", w.Code, resp)
+	}
+	w = httptest.NewRecorder()
+	SeriesHandler(opts).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/series?resolution=week", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown resolution, got %d", w.Code)
+	}
+	// 1999.5 минут — после усечения до минут это 2001 точка
+	w = httptest.NewRecorder()
+	SeriesHandler(opts).ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+		"/series?resolution=minute&from=2024-01-01T00:00:59Z&to=2024-01-02T09:20:29Z", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for range too large after truncation, got %d", w.Code)
+	}
+}
+
+func TestTimeSeriesByCombination(t *testing.T) {
+	if err := InitRedisCounter("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := Options{Prefix: "counter:test:tsdims", Dimensions: []Dimension{DimPath}, TimeSeries: true}
+	if keys, _ := redisClientCounter.Keys(ctxCounter, opts.Prefix+"*").Result(); len(keys) > 0 {
+		redisClientCounter.Del(ctxCounter, keys...)
+	}
+	defer func() {
+		if keys, _ := redisClientCounter.Keys(ctxCounter, opts.Prefix+"*").Result(); len(keys) > 0 {
+			redisClientCounter.Del(ctxCounter, keys...)
+		}
+	}()
+
+	handler := CounterMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	for _, path := range []string{"/a", "/a", "/b"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	// В прошлом часе менялся только ряд /a; бакет /b без отметки Rollup не трогает
+	seriesA := SeriesFor(opts, map[Dimension]string{DimPath: "/a"})
+	seriesB := SeriesFor(opts, map[Dimension]string{DimPath: "/b"})
+	prevHour := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	addToSeries(opts, seriesA, prevHour)
+	redisClientCounter.Set(ctxCounter, opts.bucketKey(ResMinute, seriesB, prevHour), 7, time.Hour)
+	if err := Rollup(context.Background(), opts); err != nil {
+		t.Fatalf("rollup failed: %v", err)
+	}
+	if v, _ := redisClientCounter.Get(ctxCounter, opts.bucketKey(ResHour, seriesA, prevHour)).Int64(); v != 1 {
+		t.Errorf("expected changed series to be rolled, got %d", v)
+	}
+	if redisClientCounter.Exists(ctxCounter, opts.bucketKey(ResHour, seriesB, prevHour)).Val() != 0 {
+		t.Errorf("expected unchanged series not to be rolled")
+	}
+
+	// 1. У каждого пути свой ряд, общий ряд — сумма
+	now := time.Now()
+	for path, want := range map[string]int64{"/a": 2, "/b": 1, "": 3} {
+		series := ""
+		if path != "" {
+			series = SeriesFor(opts, map[Dimension]string{DimPath: path})
+		}
+		for _, res := range []Resolution{ResMinute, ResHour} {
+			points, err := Series(context.Background(), opts, series, res, now, now)
+			if err != nil || len(points) != 1 || points[0].Count != want {
+				t.Errorf("path %q, %s: expected %d views, got %+v %v", path, res, want, points, err)
+			}
+		}
+	}
+
+	// 2. Endpoint выбирает ряд по значениям измерений
+	w := httptest.NewRecorder()
+	SeriesHandler(opts).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/series?resolution=minute&path=/b", nil))
+	resp := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp["total"] != 1.0 {
+		t.Errorf("expected total 1 for /b, got %d %v", w.Code, resp)
+	}
+}
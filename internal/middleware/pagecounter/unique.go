@@ -0,0 +1,223 @@
+package pagecounter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/middleware/session"
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// defaultUniquesRetention — сколько хранятся дневные и недельные HyperLogLog по умолчанию.
+const defaultUniquesRetention = 35 * 24 * time.Hour
+
+var (
+	// uniquePrefixes — префиксы счётчиков с уникальными посетителями, для OTel-gauge.
+	uniqueMu       sync.Mutex
+	uniquePrefixes = map[string]bool{}
+
+	dailyUniquesGauge  metric.Int64ObservableGauge
+	weeklyUniquesGauge metric.Int64ObservableGauge
+
+	// KEYS[1] — HyperLogLog суток. ARGV[1] — посетитель, ARGV[2] — хранение в секундах
+	// (отсчёт с первого посетителя суток).
+	visitorScript = redis.NewScript(`
+redis.call("PFADD", KEYS[1], ARGV[1])
+if redis.call("TTL", KEYS[1]) == -1 then
+    redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+return 1
+`)
+)
+
+func init() {
+	dailyUniquesGauge, _ = meter.Int64ObservableGauge("page_unique_visitors_daily")
+	weeklyUniquesGauge, _ = meter.Int64ObservableGauge("page_unique_visitors_weekly")
+	_, _ = meter.RegisterCallback(observeUniques, dailyUniquesGauge, weeklyUniquesGauge)
+}
+
+// observeUniques отдаёт в gauge'и уникальных посетителей за текущие сутки и неделю (UTC).
+// Только PFCOUNT: сбор метрик ничего не пишет в Redis.
+func observeUniques(ctx context.Context, o metric.Observer) error {
+	if redisClientCounter == nil {
+		return nil
+	}
+	uniqueMu.Lock()
+	prefixes := make([]string, 0, len(uniquePrefixes))
+	for prefix := range uniquePrefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	uniqueMu.Unlock()
+
+	now := time.Now()
+	for _, prefix := range prefixes {
+		opts := Options{Prefix: prefix}
+		attrs := metric.WithAttributes(attribute.String("counter", prefix))
+		if n, err := DailyUniques(ctx, opts, now); err == nil {
+			o.ObserveInt64(dailyUniquesGauge, n, attrs)
+		}
+		if n, err := WeeklyUniques(ctx, opts, now); err == nil {
+			o.ObserveInt64(weeklyUniquesGauge, n, attrs)
+		}
+	}
+	return nil
+}
+
+func (opts Options) uniquesRetention() time.Duration {
+	if opts.UniquesRetention > 0 {
+		return opts.UniquesRetention
+	}
+	return defaultUniquesRetention
+}
+
+// dayKey — HyperLogLog посетителей за сутки (UTC): <prefix>:uv:d:20060102.
+func (opts Options) dayKey(t time.Time) string {
+	return opts.Prefix + ":uv:d:" + t.UTC().Format("20060102")
+}
+
+// weekKey — HyperLogLog посетителей за ISO-неделю: <prefix>:uv:w:2006-W01.
+func (opts Options) weekKey(t time.Time) string {
+	year, week := t.UTC().ISOWeek()
+	return fmt.Sprintf("%s:uv:w:%d-W%02d", opts.Prefix, year, week)
+}
+
+// visitorID — идентификатор посетителя: Options.Visitor, иначе пользователь или ID сессии,
+// иначе SHA-256 от IP и User-Agent (сырые IP в Redis не попадают).
+func (opts Options) visitorID(r *http.Request) string {
+	if opts.Visitor != nil {
+		if id := opts.Visitor(r); id != "" {
+			return id
+		}
+	}
+	if s := session.FromContext(r.Context()); s != nil {
+		if s.UserID != "" {
+			return "u:" + s.UserID
+		}
+		return "s:" + s.ID
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	sum := sha256.Sum256([]byte(ip + "|" + r.UserAgent()))
+	return "h:" + hex.EncodeToString(sum[:16])
+}
+
+// addVisitor добавляет посетителя в HyperLogLog текущих суток (один вызов скрипта).
+func addVisitor(opts Options, r *http.Request) error {
+	return visitorScript.Run(ctxCounter, redisClientCounter, []string{opts.dayKey(time.Now())},
+		opts.visitorID(r), int64(opts.uniquesRetention()/time.Second)).Err()
+}
+
+// registerUniques включает OTel-gauge'и для префикса.
+func registerUniques(prefix string) {
+	uniqueMu.Lock()
+	uniquePrefixes[prefix] = true
+	uniqueMu.Unlock()
+}
+
+// DailyUniques — число уникальных посетителей за сутки (UTC), содержащие t.
+func DailyUniques(ctx context.Context, opts Options, t time.Time) (int64, error) {
+	return redisClientCounter.PFCount(ctxCounter, opts.dayKey(t)).Result()
+}
+
+// weekDayKeys — HyperLogLog каждого дня ISO-недели (пн–вс, UTC), содержащей t.
+func (opts Options) weekDayKeys(t time.Time) []string {
+	t = t.UTC()
+	monday := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).
+		AddDate(0, 0, -(int(t.Weekday())+6)%7)
+	days := make([]string, 0, 7)
+	for i := 0; i < 7; i++ {
+		days = append(days, opts.dayKey(monday.AddDate(0, 0, i)))
+	}
+	return days
+}
+
+// WeeklyUniques — число уникальных посетителей за ISO-неделю (пн–вс, UTC), содержащую t.
+// Считается одним PFCOUNT по дневным HyperLogLog недели и недельному ключу, если неделя
+// сохранена MaterializeWeek; ничего не записывает.
+func WeeklyUniques(ctx context.Context, opts Options, t time.Time) (int64, error) {
+	keys := append([]string{opts.weekKey(t)}, opts.weekDayKeys(t)...)
+	return redisClientCounter.PFCount(ctxCounter, keys...).Result()
+}
+
+// MaterializeWeek сливает дневные HyperLogLog недели, содержащей t, через PFMERGE
+// в недельный ключ, который хранится UniquesRetention. Нужен, чтобы число за прошедшую
+// неделю пережило удаление дневных ключей; периодически вызывается StartMaterializeWeeks.
+func MaterializeWeek(ctx context.Context, opts Options, t time.Time) error {
+	weekKey := opts.weekKey(t)
+	_, err := redisClientCounter.TxPipelined(ctxCounter, func(pipe redis.Pipeliner) error {
+		pipe.PFMerge(ctxCounter, weekKey, opts.weekDayKeys(t)...)
+		pipe.Expire(ctxCounter, weekKey, opts.uniquesRetention())
+		return nil
+	})
+	return err
+}
+
+// StartMaterializeWeeks запускает MaterializeWeek каждые interval в фоне, пока не отменён ctx:
+// для текущей недели и для недели сутки назад, чтобы после смены недели дослить последний день
+// прошлой. Запускать можно на каждом экземпляре: PFMERGE идемпотентен.
+func StartMaterializeWeeks(ctx context.Context, opts Options, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := time.Now()
+			for _, t := range []time.Time{now.Add(-24 * time.Hour), now} {
+				if err := MaterializeWeek(ctx, opts, t); err != nil {
+					log.Printf("pagecounter materialize week: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// UniquesHandler — endpoint уникальных посетителей: {"daily", "weekly", "date"}.
+// ?date=2006-01-02 — за указанные сутки и их неделю, по умолчанию — текущие.
+func UniquesHandler(opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			utils.JSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		day := time.Now().UTC()
+		if v := r.URL.Query().Get("date"); v != "" {
+			var err error
+			if day, err = time.Parse("2006-01-02", v); err != nil {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid date"})
+				return
+			}
+		}
+		daily, err := DailyUniques(r.Context(), opts, day)
+		if err != nil {
+			utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to read counters"})
+			return
+		}
+		weekly, err := WeeklyUniques(r.Context(), opts, day)
+		if err != nil {
+			utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to read counters"})
+			return
+		}
+		utils.JSON(w, http.StatusOK, map[string]interface{}{
+			"date":   day.Format("2006-01-02"),
+			"daily":  daily,
+			"weekly": weekly,
+		})
+	})
+}
@@ -0,0 +1,85 @@
+package pagecounter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+)
+
+func TestUniqueVisitors(t *testing.T) {
+	if err := InitRedisCounter("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := Options{Prefix: "counter:test:uv", UniqueVisitors: true}
+	now := time.Now()
+	redisClientCounter.Del(ctxCounter, opts.combinationsKey(), opts.dayKey(now), opts.weekKey(now))
+	defer redisClientCounter.Del(ctxCounter, opts.combinationsKey(), opts.dayKey(now), opts.weekKey(now))
+
+	handler := CounterMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	visit := func(addr, ua string) {
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("User-Agent", ua)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// 1. Повторные визиты одного посетителя не увеличивают число уникальных
+	visit("10.0.0.1:1000", "firefox")
+	visit("10.0.0.1:2000", "firefox")
+	visit("10.0.0.1:1000", "chrome")
+	visit("10.0.0.2:1000", "firefox")
+	if n, _ := DailyUniques(context.Background(), opts, now); n != 3 {
+		t.Errorf("expected 3 daily uniques, got %d", n)
+	}
+	if v, _ := redisClientCounter.HGet(ctxCounter, opts.combinationsKey(), "").Int64(); v != 4 {
+		t.Errorf("expected 4 page views, got %d", v)
+	}
+
+	// 2. Недельные — объединение дневных (PFCOUNT по ключам недели), без записи недельного ключа:
+	// посетитель, приходивший в несколько дней недели, считается один раз
+	monday := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tuesday := monday.AddDate(0, 0, 1)
+	wednesday := monday.AddDate(0, 0, 2)
+	nextMonday := monday.AddDate(0, 0, 7)
+	weekKeys := []string{opts.dayKey(monday), opts.dayKey(tuesday), opts.dayKey(wednesday), opts.dayKey(nextMonday), opts.weekKey(monday)}
+	redisClientCounter.Del(ctxCounter, weekKeys...)
+	defer redisClientCounter.Del(ctxCounter, weekKeys...)
+	redisClientCounter.PFAdd(ctxCounter, opts.dayKey(monday), "a", "b")
+	redisClientCounter.PFAdd(ctxCounter, opts.dayKey(tuesday), "a", "b", "c")
+	redisClientCounter.PFAdd(ctxCounter, opts.dayKey(wednesday), "a")
+	redisClientCounter.PFAdd(ctxCounter, opts.dayKey(nextMonday), "a", "d")
+	if n, _ := WeeklyUniques(context.Background(), opts, tuesday); n != 3 {
+		t.Errorf("expected 3 weekly uniques, got %d", n)
+	}
+	if redisClientCounter.Exists(ctxCounter, opts.weekKey(monday)).Val() != 0 {
+		t.Errorf("expected WeeklyUniques not to write the week key")
+	}
+
+	// Сохранённая неделя переживает удаление дневных ключей
+	if err := MaterializeWeek(context.Background(), opts, tuesday); err != nil {
+		t.Fatalf("failed to materialize week: %v", err)
+	}
+	redisClientCounter.Del(ctxCounter, opts.dayKey(monday), opts.dayKey(tuesday), opts.dayKey(wednesday))
+	if n, _ := WeeklyUniques(context.Background(), opts, tuesday); n != 3 {
+		t.Errorf("expected 3 weekly uniques after daily keys expired, got %d", n)
+	}
+	redisClientCounter.Del(ctxCounter, opts.weekKey(monday))
+	redisClientCounter.PFAdd(ctxCounter, opts.dayKey(monday), "a", "b")
+	redisClientCounter.PFAdd(ctxCounter, opts.dayKey(tuesday), "a", "c")
+
+	// 3. Endpoint за указанную дату
+	w := httptest.NewRecorder()
+	UniquesHandler(opts).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/uniques?date=2024-01-02", nil))
+	resp := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["daily"] != 2.0 || resp["weekly"] != 3.0 {
+		t.Errorf("unexpected uniques response: %v", resp)
+	}
+}
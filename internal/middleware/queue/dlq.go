@@ -0,0 +1,217 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+// reapBatchSize — сколько просроченных задач Reap обрабатывает за один вызов скрипта.
+const reapBatchSize = 100
+
+var (
+	// KEYS — задачи в работе, захваты, счётчики доставок, куда вернуть задачу, DLQ.
+	// ARGV[1] — граница захвата в мс (всё, что захвачено раньше, просрочено),
+	// ARGV[2] — максимум доставок (0 — без ограничения), ARGV[3] — размер пачки,
+	// ARGV[4] — число приоритетных очередей: если > 1, задача возвращается в очередь своего приоритета.
+	// Возвращает {возвращено, отправлено в DLQ}.
+	reapScript = redis.NewScript(laneFuncs + `
+local lanes = tonumber(ARGV[4])
+local expired = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[3]))
+local max = tonumber(ARGV[2])
+local requeued, dead = 0, 0
+for _, item in ipairs(expired) do
+    redis.call("ZREM", KEYS[2], item)
+    if redis.call("LREM", KEYS[1], 1, item) == 1 then
+        if max > 0 and tonumber(redis.call("HGET", KEYS[3], item) or "0") >= max then
+            redis.call("HDEL", KEYS[3], item)
+            redis.call("LPUSH", KEYS[5], item)
+            dead = dead + 1
+        else
+            local target = KEYS[4]
+            if lanes > 1 then
+                target = lane(KEYS[4], lanes, item)
+            end
+            redis.call("LPUSH", target, item)
+            requeued = requeued + 1
+        end
+    end
+end
+return {requeued, dead}
+`)
+
+	// Списки ожидающих, которые давно не делали блокирующий вызов (экземпляр упал между BLMOVE
+	// и handoffScript), возвращаются в голову своих очередей. KEYS[1] — ZSET ожидающих,
+	// KEYS[2..] — очереди в порядке laneKeys. ARGV[1] — граница в мс, ARGV[2] — префикс
+	// списков ожидающих, ARGV[3] — размер пачки. Возвращает число возвращённых задач.
+	reclaimHandoffScript = redis.NewScript(handoffFuncs + `
+local moved = 0
+for _, token in ipairs(redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[3]))) do
+    moved = moved + returnHandoff(ARGV[2], token)
+end
+return moved
+`)
+
+	// KEYS[1] — DLQ, KEYS[2] — очередь. ARGV — задачи; без аргументов переносится вся DLQ.
+	// Возвращает число перенесённых задач.
+	requeueDeadScript = redis.NewScript(`
+local moved = 0
+if #ARGV == 0 then
+    while redis.call("RPOPLPUSH", KEYS[1], KEYS[2]) do
+        moved = moved + 1
+    end
+    return moved
+end
+for _, item in ipairs(ARGV) do
+    if redis.call("LREM", KEYS[1], 1, item) == 1 then
+        redis.call("LPUSH", KEYS[2], item)
+        moved = moved + 1
+    end
+end
+return moved
+`)
+)
+
+// Reap возвращает в очередь задачи, которые пробыли в работе дольше VisibilityTimeout
+// (например, экземпляр упал, не успев ответить), а исчерпавшие MaxDeliveries — в DLQ.
+// Задачи, застрявшие в списках ожидающих long polling дольше VisibilityTimeout, тоже
+// возвращаются в очередь. Возвращает число возвращённых задач и задач, отправленных в DLQ.
+func Reap(ctx context.Context, opts Options) (requeued, dead int, err error) {
+	deadline := time.Now().Add(-opts.visibilityTimeout()).UnixMilli()
+	handedBack, err := reclaimHandoffScript.Run(ctxQueue, redisClientQueue, append([]string{opts.waitersKey()}, opts.laneKeys()...),
+		deadline, opts.handoffPrefix(), reapBatchSize).Int()
+	if err != nil {
+		return 0, 0, err
+	}
+	requeued += handedBack
+	reapedCounter.Add(ctx, int64(handedBack))
+
+	keys := []string{opts.ProcessingKey, opts.claimsKey(), opts.deliveriesKey(), opts.retryKey(), opts.deadLetterKey()}
+	// С RetryKey все задачи возвращаются в него, без разбора приоритетов
+	lanes := opts.Priorities
+	if opts.RetryKey != "" {
+		lanes = 0
+	}
+	for {
+		res, err := reapScript.Run(ctxQueue, redisClientQueue, keys, deadline, opts.MaxDeliveries, reapBatchSize, lanes).Result()
+		if err != nil {
+			return requeued, dead, err
+		}
+		values, _ := res.([]interface{})
+		if len(values) != 2 {
+			return requeued, dead, nil
+		}
+		r, _ := values[0].(int64)
+		d, _ := values[1].(int64)
+		requeued += int(r)
+		dead += int(d)
+		reapedCounter.Add(ctx, r)
+		deadCounter.Add(ctx, d)
+		if r+d < reapBatchSize {
+			return requeued, dead, nil
+		}
+	}
+}
+
+// StartReaper запускает Reap каждые interval в фоне, пока не отменён ctx.
+// Запускать можно на каждом экземпляре: скрипт атомарен, задача не вернётся дважды.
+func StartReaper(ctx context.Context, opts Options, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, _, err := Reap(ctx, opts); err != nil {
+				log.Printf("queue reaper: %v", err)
+			}
+		}
+	}()
+}
+
+// DeadLetterHandler — админский endpoint для DLQ очереди opts:
+//   - GET — список задач (?limit=N, по умолчанию 100) и общее число;
+//   - POST — вернуть задачи в очередь: тело {"items": [...]}, без тела — все;
+//   - DELETE — очистить DLQ.
+//
+// Endpoint стоит закрывать авторизацией (auth.Auth).
+func DeadLetterHandler(opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dlq := opts.deadLetterKey()
+
+		switch r.Method {
+		case http.MethodGet:
+			limit := int64(100)
+			if v := r.URL.Query().Get("limit"); v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil || n <= 0 {
+					utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+					return
+				}
+				limit = n
+			}
+			// Самые старые задачи в конце списка, показываем их первыми
+			items, err := redisClientQueue.LRange(ctxQueue, dlq, -limit, -1).Result()
+			if err != nil {
+				utils.JSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+				items[i], items[j] = items[j], items[i]
+			}
+			total, err := redisClientQueue.LLen(ctxQueue, dlq).Result()
+			if err != nil {
+				utils.JSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			utils.JSON(w, http.StatusOK, map[string]interface{}{"items": items, "total": total})
+
+		case http.MethodPost:
+			var body struct {
+				Items []string `json:"items"`
+			}
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+					return
+				}
+			}
+			args := make([]interface{}, len(body.Items))
+			for i, item := range body.Items {
+				args[i] = item
+			}
+			moved, err := requeueDeadScript.Run(ctxQueue, redisClientQueue, []string{dlq, opts.SourceKey}, args...).Int()
+			if err != nil {
+				utils.JSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			utils.JSON(w, http.StatusOK, map[string]int{"requeued": moved})
+
+		case http.MethodDelete:
+			var purged *redis.IntCmd
+			_, err := redisClientQueue.TxPipelined(ctxQueue, func(pipe redis.Pipeliner) error {
+				purged = pipe.LLen(ctxQueue, dlq)
+				pipe.Del(ctxQueue, dlq)
+				return nil
+			})
+			if err != nil {
+				utils.JSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			utils.JSON(w, http.StatusOK, map[string]int64{"purged": purged.Val()})
+
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			utils.JSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		}
+	})
+}
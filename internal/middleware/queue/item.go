@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Item — задача, выданная текущему запросу.
+type Item struct {
+	// ID — идентификатор задачи: из конверта задачи или ID записи потока.
+	// Пусто для задач, положенных в список "как есть", без конверта.
+	ID string
+	// Payload — тело задачи без изменений.
+	Payload []byte
+	// Value — Payload, разобранный как JSON; nil, если это не JSON.
+	Value interface{}
+	// Attempt — номер доставки, начиная с 1.
+	Attempt int
+	// EnqueuedAt — время постановки в очередь; нулевое, если неизвестно.
+	EnqueuedAt time.Time
+}
+
+// Decode разбирает Payload как JSON в v.
+func (it Item) Decode(v interface{}) error {
+	return json.Unmarshal(it.Payload, v)
+}
+
+// envelope — формат задачи в списке: {"id": ..., "payload": ..., "enqueued_at": ...}.
+// Задачи, не похожие на конверт, считаются "голым" payload.
+type envelope struct {
+	ID         string          `json:"id"`
+	Payload    json.RawMessage `json:"payload"`
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+}
+
+// ItemFromContext возвращает задачу, выданную текущему запросу
+// QueueMiddleware или StreamMiddleware.
+func ItemFromContext(ctx context.Context) (Item, bool) {
+	d, ok := ctx.Value(deliveryContextKey{}).(*delivery)
+	if !ok {
+		return Item{}, false
+	}
+	return d.item, true
+}
+
+// listItem разбирает задачу из списка.
+func listItem(raw string, attempt int64) Item {
+	it := Item{Payload: []byte(raw), Attempt: int(attempt)}
+	var env envelope
+	if strings.HasPrefix(raw, "{") && json.Unmarshal([]byte(raw), &env) == nil && env.ID != "" && env.Payload != nil {
+		it.ID = env.ID
+		it.Payload = env.Payload
+		it.EnqueuedAt = env.EnqueuedAt
+	}
+	it.Value = decodeJSON(it.Payload)
+	return it
+}
+
+// streamItem разбирает запись потока: payload — поле "payload", а если его нет —
+// все поля записи как JSON-объект. Время постановки берётся из ID записи.
+func streamItem(msg redis.XMessage, attempt int64) Item {
+	it := Item{ID: msg.ID, Attempt: int(attempt)}
+	if payload, ok := msg.Values["payload"].(string); ok {
+		it.Payload = []byte(payload)
+	} else {
+		it.Payload, _ = json.Marshal(msg.Values)
+	}
+	if ms, err := strconv.ParseInt(strings.SplitN(msg.ID, "-", 2)[0], 10, 64); err == nil {
+		it.EnqueuedAt = time.UnixMilli(ms)
+	}
+	it.Value = decodeJSON(it.Payload)
+	return it
+}
+
+func decodeJSON(data []byte) interface{} {
+	var v interface{}
+	if json.Unmarshal(data, &v) != nil {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,69 @@
+package queue
+
+import "strconv"
+
+// defaultStarvationEvery — по умолчанию каждая десятая выдача начинается с младшей очереди.
+const defaultStarvationEvery = 10
+
+// laneFuncs — Lua-функции, общие для скриптов с приоритетными очередями.
+// priority(item) — приоритет из конверта задачи (0, если его нет);
+// lane(base, lanes, item) — очередь для задачи, как laneKey.
+const laneFuncs = `
+local function priority(item)
+    local ok, env = pcall(cjson.decode, item)
+    if ok and type(env) == "table" then
+        return math.floor(tonumber(env.priority) or 0)
+    end
+    return 0
+end
+
+local function lane(base, lanes, item)
+    local p = priority(item)
+    if p > lanes - 1 then
+        p = lanes - 1
+    end
+    if p <= 0 then
+        return base
+    end
+    return base .. ":p" .. p
+end
+`
+
+// laneKey возвращает очередь для задачи с приоритетом priority: base для 0,
+// <base>:p<N> для N > 0. Приоритет ограничен числом очередей lanes.
+func laneKey(base string, lanes, priority int) string {
+	if priority > lanes-1 {
+		priority = lanes - 1
+	}
+	if priority <= 0 {
+		return base
+	}
+	return base + ":p" + strconv.Itoa(priority)
+}
+
+// laneKeys — очереди задач от высшего приоритета к низшему.
+func (opts Options) laneKeys() []string {
+	if opts.Priorities <= 1 {
+		return []string{opts.SourceKey}
+	}
+	keys := make([]string, 0, opts.Priorities)
+	for p := opts.Priorities - 1; p >= 0; p-- {
+		keys = append(keys, laneKey(opts.SourceKey, opts.Priorities, p))
+	}
+	return keys
+}
+
+func (opts Options) starvationEvery() int {
+	switch {
+	case opts.StarvationEvery < 0:
+		return 0
+	case opts.StarvationEvery == 0:
+		return defaultStarvationEvery
+	}
+	return opts.StarvationEvery
+}
+
+// ticksKey — счётчик выдач для защиты от голодания.
+func (opts Options) ticksKey() string {
+	return opts.SourceKey + ":ticks"
+}
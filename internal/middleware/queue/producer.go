@@ -0,0 +1,288 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// defaultDedupTTL — сколько помнить ключ дедупликации.
+	defaultDedupTTL = 24 * time.Hour
+	// promoteBatchSize — сколько отложенных задач Promote переносит за один вызов скрипта.
+	promoteBatchSize = 100
+	// maxEnqueueBodySize — предел тела запроса EnqueueHandler.
+	maxEnqueueBodySize = 1 << 20
+)
+
+var (
+	// KEYS[1] — очередь (нужного приоритета), KEYS[2] — ZSET отложенных задач, KEYS[3] — ключ дедупликации.
+	// ARGV[1] — конверт задачи, ARGV[2] — ID, ARGV[3] — время запуска в мс (0 — сразу),
+	// ARGV[4] — TTL ключа дедупликации в мс (0 — без дедупликации), ARGV[5] — "1" для срочной задачи.
+	// Возвращает {1, ID} или {0, ID уже поставленной задачи} для дубликата.
+	enqueueScript = redis.NewScript(`
+if ARGV[4] ~= "0" then
+    local existing = redis.call("GET", KEYS[3])
+    if existing then
+        return {0, existing}
+    end
+    redis.call("SET", KEYS[3], ARGV[2], "PX", ARGV[4])
+end
+if tonumber(ARGV[3]) > 0 then
+    redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+elseif ARGV[5] == "1" then
+    redis.call("RPUSH", KEYS[1], ARGV[1])
+else
+    redis.call("LPUSH", KEYS[1], ARGV[1])
+end
+return {1, ARGV[2]}
+`)
+
+	// KEYS[1] — ZSET отложенных задач, KEYS[2] — очередь. ARGV[1] — текущее время в мс,
+	// ARGV[2] — размер пачки, ARGV[3] — число приоритетных очередей.
+	// Наступившие задачи атомарно переносятся в очередь своего приоритета; при одной очереди
+	// срочные (priority > 0 в конверте) встают в её голову. Возвращает число перенесённых задач.
+	promoteScript = redis.NewScript(laneFuncs + `
+local lanes = tonumber(ARGV[3])
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[2]))
+for _, item in ipairs(due) do
+    redis.call("ZREM", KEYS[1], item)
+    if lanes > 1 then
+        redis.call("LPUSH", lane(KEYS[2], lanes, item), item)
+    elseif priority(item) > 0 then
+        redis.call("RPUSH", KEYS[2], item)
+    else
+        redis.call("LPUSH", KEYS[2], item)
+    end
+end
+return #due
+`)
+)
+
+// ErrDuplicate — задача с таким ключом дедупликации уже поставлена.
+// Enqueue при этом возвращает ID ранее поставленной задачи.
+var ErrDuplicate = errors.New("duplicate task")
+
+// EnqueueOptions — параметры постановки задачи.
+type EnqueueOptions struct {
+	// ID задачи. Пусто — сгенерировать случайный.
+	ID string
+	// DedupKey — ключ идемпотентности: повторная постановка с тем же ключом в течение
+	// Producer.DedupTTL не создаёт новую задачу, а возвращает ErrDuplicate.
+	DedupKey string
+	// Delay — отложить выполнение на указанное время.
+	Delay time.Duration
+	// At — выполнить не раньше этого момента (имеет приоритет над Delay).
+	At time.Time
+	// Priority — приоритет задачи. При нескольких очередях (Producer.Priorities > 1) задача
+	// попадает в очередь своего приоритета; при одной — срочная (> 0) встаёт в её голову.
+	Priority int
+}
+
+// Producer ставит задачи в очередь, которую читает QueueMiddleware.
+type Producer struct {
+	// Queue — список задач (SourceKey у QueueMiddleware).
+	Queue string
+	// DedupTTL — сколько помнить ключи дедупликации (0 — defaultDedupTTL).
+	DedupTTL time.Duration
+	// Priorities — число приоритетных очередей; должно совпадать с Options.Priorities потребителя.
+	Priorities int
+}
+
+// NewProducer создаёт Producer для очереди queueKey.
+func NewProducer(queueKey string) *Producer {
+	return &Producer{Queue: queueKey, DedupTTL: defaultDedupTTL}
+}
+
+func (p *Producer) delayedKey() string {
+	return p.Queue + ":delayed"
+}
+
+func (p *Producer) dedupKey(key string) string {
+	return p.Queue + ":dedup:" + key
+}
+
+// Enqueue ставит payload в очередь и возвращает ID задачи. payload кодируется в JSON;
+// []byte и json.RawMessage должны уже содержать JSON и передаются как есть.
+// Задача хранится в конверте {"id", "payload", "enqueued_at"}, который разбирает ItemFromContext.
+func (p *Producer) Enqueue(ctx context.Context, payload interface{}, opts EnqueueOptions) (string, error) {
+	var raw json.RawMessage
+	switch v := payload.(type) {
+	case json.RawMessage:
+		raw = v
+	case []byte:
+		raw = v
+	default:
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode payload: %w", err)
+		}
+		raw = data
+	}
+	if !json.Valid(raw) {
+		return "", errors.New("payload is not valid JSON")
+	}
+
+	id := opts.ID
+	if id == "" {
+		var err error
+		if id, err = newTaskID(); err != nil {
+			return "", err
+		}
+	}
+
+	env, err := json.Marshal(struct {
+		envelope
+		Priority int `json:"priority,omitempty"`
+	}{envelope{ID: id, Payload: raw, EnqueuedAt: time.Now().UTC()}, opts.Priority})
+	if err != nil {
+		return "", err
+	}
+
+	var runAt int64
+	switch {
+	case !opts.At.IsZero():
+		runAt = opts.At.UnixMilli()
+	case opts.Delay > 0:
+		runAt = time.Now().Add(opts.Delay).UnixMilli()
+	}
+
+	dedupTTL := int64(0)
+	dedupKey := p.dedupKey("")
+	if opts.DedupKey != "" {
+		dedupKey = p.dedupKey(opts.DedupKey)
+		dedupTTL = p.DedupTTL.Milliseconds()
+		if dedupTTL <= 0 {
+			dedupTTL = defaultDedupTTL.Milliseconds()
+		}
+	}
+	target, urgent := p.Queue, "0"
+	if p.Priorities > 1 {
+		target = laneKey(p.Queue, p.Priorities, opts.Priority)
+	} else if opts.Priority > 0 {
+		urgent = "1"
+	}
+
+	res, err := enqueueScript.Run(ctxQueue, redisClientQueue, []string{target, p.delayedKey(), dedupKey},
+		string(env), id, runAt, dedupTTL, urgent).Result()
+	if err != nil {
+		return "", err
+	}
+	values, _ := res.([]interface{})
+	if len(values) != 2 {
+		return "", fmt.Errorf("unexpected enqueue script result: %v", res)
+	}
+	created, _ := values[0].(int64)
+	taskID, _ := values[1].(string)
+	if created == 0 {
+		return taskID, ErrDuplicate
+	}
+	enqueuedCounter.Add(ctx, 1)
+	return taskID, nil
+}
+
+// Promote переносит в очередь отложенные задачи, время которых наступило.
+func (p *Producer) Promote(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, err := promoteScript.Run(ctxQueue, redisClientQueue, []string{p.delayedKey(), p.Queue},
+			time.Now().UnixMilli(), promoteBatchSize, p.Priorities).Int()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < promoteBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// StartScheduler запускает Promote каждые interval в фоне, пока не отменён ctx.
+// Запускать можно на каждом экземпляре: скрипт атомарен, задача не будет перенесена дважды.
+func (p *Producer) StartScheduler(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := p.Promote(ctx); err != nil {
+				log.Printf("queue scheduler: %v", err)
+			}
+		}
+	}()
+}
+
+// newTaskID генерирует случайный ID задачи.
+func newTaskID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// EnqueueHandler — HTTP endpoint постановки задач. Тело запроса — JSON payload задачи.
+// Параметры: заголовок Idempotency-Key (ключ дедупликации), query delay (например, 30s)
+// и priority. Отвечает 202 с {"id": ...}; для дубликата — 200 с ID ранее поставленной задачи.
+func EnqueueHandler(p *Producer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			utils.JSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxEnqueueBodySize+1))
+		if err != nil {
+			utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "failed to read body"})
+			return
+		}
+		if len(body) > maxEnqueueBodySize {
+			utils.JSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "payload too large"})
+			return
+		}
+		if !json.Valid(body) {
+			utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+			return
+		}
+
+		opts := EnqueueOptions{DedupKey: r.Header.Get("Idempotency-Key")}
+		if v := r.URL.Query().Get("delay"); v != "" {
+			if opts.Delay, err = time.ParseDuration(v); err != nil || opts.Delay < 0 {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid delay"})
+				return
+			}
+		}
+		if v := r.URL.Query().Get("priority"); v != "" {
+			if opts.Priority, err = strconv.Atoi(v); err != nil || opts.Priority < 0 {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid priority"})
+				return
+			}
+		}
+
+		id, err := p.Enqueue(r.Context(), json.RawMessage(body), opts)
+		switch {
+		case errors.Is(err, ErrDuplicate):
+			utils.JSON(w, http.StatusOK, map[string]interface{}{"id": id, "duplicate": true})
+		case err != nil:
+			utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to enqueue task"})
+		default:
+			utils.JSON(w, http.StatusAccepted, map[string]string{"id": id})
+		}
+	})
+}
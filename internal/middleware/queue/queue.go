@@ -2,8 +2,11 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-portfolio/http-middleware/internal/utils"
@@ -16,21 +19,106 @@ var (
 	redisClientQueue *redis.Client
 	ctxQueue         = context.Background()
 
+	// KEYS[1..n] — очереди задач от высшего приоритета к низшему, затем задачи в работе,
+	// ZSET захватов (задача → время захвата в мс), HASH счётчиков доставок и счётчик выдач.
+	// ARGV[1] — текущее время в мс, ARGV[2] — каждая какая выдача начинается с младшей
+	// очереди (0 — никогда). Младшие очереди при этом перебираются по кругу.
+	// Возвращает {задача, номер доставки, номер очереди в KEYS} или false, если все очереди пусты.
 	queueScript = redis.NewScript(`
+local n = #KEYS - 4
+local processing, claims, deliveries, ticks = KEYS[n + 1], KEYS[n + 2], KEYS[n + 3], KEYS[n + 4]
+local order = {}
+local every = tonumber(ARGV[2])
+if every > 0 and n > 1 then
+    local t = redis.call("INCR", ticks)
+    if t % every == 0 then
+        table.insert(order, 2 + math.floor(t / every) % (n - 1))
+    end
+end
+for i = 1, n do
+    table.insert(order, i)
+end
+for _, i in ipairs(order) do
+    local item = redis.call("RPOPLPUSH", KEYS[i], processing)
+    if item then
+        redis.call("ZADD", claims, ARGV[1], item)
+        return {item, redis.call("HINCRBY", deliveries, item, 1), i}
+    end
+end
+return false
+`)
+
+	// Передача задачи, которую BLMOVE перенёс в список ожидающего (KEYS[1]): задача переходит
+	// в работу (KEYS[2]) вместе с записью о захвате (KEYS[3]) и доставке (KEYS[4]).
+	// ARGV[1] — текущее время в мс.
+	// Возвращает {задача, номер доставки} или false, если список ожидающего пуст.
+	handoffScript = redis.NewScript(`
 local item = redis.call("RPOPLPUSH", KEYS[1], KEYS[2])
-return item
+if not item then
+    return false
+end
+redis.call("ZADD", KEYS[3], ARGV[1], item)
+return {item, redis.call("HINCRBY", KEYS[4], item, 1)}
+`)
+
+	// Ожидающий закончил: задачи, которые BLMOVE успел перенести в его списки, но которые
+	// не были переданы в работу, возвращаются в голову своих очередей, а ожидающий снимается
+	// с учёта. KEYS — как у reclaimHandoffScript, ARGV[1] — префикс списков, ARGV[2] — токен.
+	// Возвращает число возвращённых задач.
+	releaseHandoffScript = redis.NewScript(handoffFuncs + `
+return returnHandoff(ARGV[1], ARGV[2])
+`)
+
+	// KEYS — задачи в работе, захваты, счётчики доставок. ARGV[1] — задача.
+	ackScript = redis.NewScript(`
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[3], ARGV[1])
+return redis.call("LREM", KEYS[1], 1, ARGV[1])
+`)
+
+	// KEYS[1..3] — как у ackScript, KEYS[4] — куда вернуть задачу, KEYS[5] — DLQ.
+	// ARGV[1] — задача, ARGV[2] — максимум доставок (0 — без ограничения).
+	// Задача возвращается, только если она ещё числится в работе: повторный nack
+	// не размножит её. Исчерпавшая доставки задача уходит в DLQ.
+	// Возвращает 1, если задача возвращена, 2 — если отправлена в DLQ, 0 — если её уже нет.
+	nackScript = redis.NewScript(`
+if redis.call("LREM", KEYS[1], 1, ARGV[1]) == 0 then
+    return 0
+end
+redis.call("ZREM", KEYS[2], ARGV[1])
+local max = tonumber(ARGV[2])
+if max > 0 and tonumber(redis.call("HGET", KEYS[3], ARGV[1]) or "0") >= max then
+    redis.call("HDEL", KEYS[3], ARGV[1])
+    redis.call("LPUSH", KEYS[5], ARGV[1])
+    return 2
+end
+redis.call("LPUSH", KEYS[4], ARGV[1])
+return 1
 `)
 
 	// Метрики OpenTelemetry
-	meter          = otel.Meter("queue")
+	meter            = otel.Meter("queue")
 	processedCounter metric.Int64Counter
+	enqueuedCounter  metric.Int64Counter
 	emptyCounter     metric.Int64Counter
+	ackedCounter     metric.Int64Counter
+	nackedCounter    metric.Int64Counter
+	reapedCounter    metric.Int64Counter
+	deadCounter      metric.Int64Counter
 	durationHist     metric.Float64Histogram
 )
 
+// ErrNoDelivery — в контексте нет задачи, полученной QueueMiddleware.
+var ErrNoDelivery = errors.New("no queue item in context")
+
 func init() {
 	processedCounter, _ = meter.Int64Counter("queue_processed_total")
 	emptyCounter, _ = meter.Int64Counter("queue_empty_total")
+	enqueuedCounter, _ = meter.Int64Counter("queue_enqueued_total")
+	ackedCounter, _ = meter.Int64Counter("queue_acked_total")
+	nackedCounter, _ = meter.Int64Counter("queue_nacked_total")
+	reapedCounter, _ = meter.Int64Counter("queue_reaped_total")
+	deadCounter, _ = meter.Int64Counter("queue_dead_lettered_total")
 	durationHist, _ = meter.Float64Histogram("queue_processing_duration_seconds")
 }
 
@@ -46,38 +134,415 @@ func InitRedisQueue(addr, password string, db int) error {
 	return nil
 }
 
+// Options — настройки QueueMiddlewareWithOptions.
+type Options struct {
+	// SourceKey — список, из которого берутся задачи (производители делают LPUSH).
+	SourceKey string
+	// ProcessingKey — список задач, взятых в работу и ещё не подтверждённых.
+	ProcessingKey string
+	// RetryKey — куда возвращать задачу при nack. Пусто — обратно в её очередь.
+	RetryKey string
+	// Priorities — число приоритетных очередей (0 и 1 — одна очередь SourceKey).
+	// Задачи приоритета p > 0 лежат в <SourceKey>:p<p> и выдаются раньше задач младших приоритетов.
+	Priorities int
+	// StarvationEvery — каждая StarvationEvery-я выдача начинается с одной из младших очередей
+	// (по кругу), чтобы поток срочных задач не блокировал остальные навсегда.
+	// 0 — defaultStarvationEvery, < 0 — отключить.
+	StarvationEvery int
+	// VisibilityTimeout — сколько задача может оставаться в работе без подтверждения,
+	// прежде чем Reap вернёт её в очередь (0 — defaultVisibilityTimeout).
+	VisibilityTimeout time.Duration
+	// MaxDeliveries — после стольких неудачных доставок задача уходит в DLQ (0 — без ограничения).
+	MaxDeliveries int
+	// DeadLetterKey — список "мёртвых" задач. Пусто — <SourceKey>:dead.
+	DeadLetterKey string
+	// WaitTimeout — сколько ждать задачу, если очередь пуста (long polling). 0 — сразу 204.
+	// Ожидание также ограничено контекстом запроса.
+	WaitTimeout time.Duration
+	// ExposeHeader — отдавать задачу клиенту в заголовке ответа X-Queue-Item (как раньше).
+	// Handler'у задача доступна через ItemFromContext независимо от этой настройки.
+	ExposeHeader bool
+}
+
+const (
+	// defaultVisibilityTimeout — время на обработку задачи по умолчанию.
+	defaultVisibilityTimeout = 30 * time.Second
+	// blockSlice — максимальная длительность одного блокирующего вызова при ожидании задачи.
+	blockSlice = time.Second
+)
+
+func (opts Options) retryKey() string {
+	if opts.RetryKey != "" {
+		return opts.RetryKey
+	}
+	return opts.SourceKey
+}
+
+func (opts Options) deadLetterKey() string {
+	if opts.DeadLetterKey != "" {
+		return opts.DeadLetterKey
+	}
+	return opts.SourceKey + ":dead"
+}
+
+func (opts Options) visibilityTimeout() time.Duration {
+	if opts.VisibilityTimeout > 0 {
+		return opts.VisibilityTimeout
+	}
+	return defaultVisibilityTimeout
+}
+
+// claimsKey — ZSET задач в работе с временем захвата.
+func (opts Options) claimsKey() string {
+	return opts.ProcessingKey + ":claims"
+}
+
+// deliveriesKey — HASH с числом доставок каждой задачи.
+func (opts Options) deliveriesKey() string {
+	return opts.ProcessingKey + ":deliveries"
+}
+
+// waitersKey — ZSET ожидающих запросов (токен → время последнего блокирующего вызова в мс).
+func (opts Options) waitersKey() string {
+	return opts.ProcessingKey + ":waiters"
+}
+
+// handoffPrefix — начало ключей списков ожидающих.
+func (opts Options) handoffPrefix() string {
+	return opts.ProcessingKey + ":handoff:"
+}
+
+// handoffKey — список, в который BLMOVE переносит задачу из очереди номер lane
+// (с 1, в порядке laneKeys) для ожидающего с токеном token.
+func (opts Options) handoffKey(token string, lane int) string {
+	return opts.handoffPrefix() + token + ":" + strconv.Itoa(lane)
+}
+
+// handoffFuncs — Lua-функция returnHandoff(prefix, token), общая для releaseHandoffScript
+// и reclaimHandoffScript: переносит задачи из списков ожидающего обратно в голову очередей
+// (KEYS[2..] — очереди в порядке laneKeys) и убирает его из ZSET ожидающих (KEYS[1]).
+const handoffFuncs = `
+local function returnHandoff(prefix, token)
+    local moved = 0
+    for i = 2, #KEYS do
+        local handoff = prefix .. token .. ":" .. (i - 1)
+        local item = redis.call("RPOP", handoff)
+        while item do
+            redis.call("RPUSH", KEYS[i], item)
+            moved = moved + 1
+            item = redis.call("RPOP", handoff)
+        end
+    end
+    redis.call("ZREM", KEYS[1], token)
+    return moved
+end
+`
+
+// delivery — задача, выданная текущему запросу, и способ её подтвердить в конкретном бэкенде.
+type delivery struct {
+	item Item
+	ack  func(ctx context.Context) error
+	nack func(ctx context.Context) error
+
+	mu      sync.Mutex
+	settled bool
+}
+
+type deliveryContextKey struct{}
+
+// settle подтверждает (ack) или возвращает (nack) задачу. Повторные вызовы ничего не делают.
+func (d *delivery) settle(ctx context.Context, ack bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.settled {
+		return nil
+	}
+
+	if ack {
+		if err := d.ack(ctx); err != nil {
+			return err
+		}
+		ackedCounter.Add(ctx, 1)
+	} else {
+		if err := d.nack(ctx); err != nil {
+			return err
+		}
+		nackedCounter.Add(ctx, 1)
+	}
+	d.settled = true
+	return nil
+}
+
+// serve передаёт задачу handler'у и, если он не вызвал Ack/Nack сам, подтверждает её
+// по статусу ответа: 2xx — ack, 5xx или паника — nack. Паника передаётся дальше, в Recovery.
+func (d *delivery) serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), deliveryContextKey{}, d)
+	rw := utils.NewResponseWriter(w)
+
+	defer func() {
+		if p := recover(); p != nil {
+			d.settle(ctx, false)
+			panic(p)
+		}
+		switch {
+		case rw.Status >= 200 && rw.Status < 300:
+			d.settle(ctx, true)
+		case rw.Status >= 500:
+			d.settle(ctx, false)
+		}
+	}()
+
+	next.ServeHTTP(rw, r.WithContext(ctx))
+}
+
+// listDelivery — задача из списка: ack удаляет её из ProcessingKey, nack возвращает
+// в очередь или отправляет в DLQ.
+func listDelivery(item string, attempt int64, lane string, opts Options) *delivery {
+	keys := []string{opts.ProcessingKey, opts.claimsKey(), opts.deliveriesKey()}
+	return &delivery{
+		item: listItem(item, attempt),
+		ack: func(ctx context.Context) error {
+			return ackScript.Run(ctxQueue, redisClientQueue, keys, item).Err()
+		},
+		nack: func(ctx context.Context) error {
+			retryKey := lane
+			if opts.RetryKey != "" {
+				retryKey = opts.RetryKey
+			}
+			nackKeys := append(keys[:3:3], retryKey, opts.deadLetterKey())
+			res, err := nackScript.Run(ctxQueue, redisClientQueue, nackKeys, item, opts.MaxDeliveries).Int()
+			if err == nil && res == 2 {
+				deadCounter.Add(ctx, 1)
+			}
+			return err
+		},
+	}
+}
+
+// Ack подтверждает обработку задачи текущего запроса: она удаляется из списка задач в работе.
+// После явного Ack middleware не подтверждает задачу по статусу ответа.
+func Ack(ctx context.Context) error {
+	d, ok := ctx.Value(deliveryContextKey{}).(*delivery)
+	if !ok {
+		return ErrNoDelivery
+	}
+	return d.settle(ctx, true)
+}
+
+// Nack возвращает задачу текущего запроса в очередь (или в RetryKey) для повторной обработки,
+// а исчерпавшую MaxDeliveries — в DLQ.
+func Nack(ctx context.Context) error {
+	d, ok := ctx.Value(deliveryContextKey{}).(*delivery)
+	if !ok {
+		return ErrNoDelivery
+	}
+	return d.settle(ctx, false)
+}
+
+// QueueMiddleware берёт задачу из sourceKey в processingKey и передаёт её handler'у
+// (см. ItemFromContext).
+// Ответ 2xx подтверждает задачу, 5xx или паника возвращают её в sourceKey.
 func QueueMiddleware(sourceKey, processingKey string) func(http.Handler) http.Handler {
+	return QueueMiddlewareWithOptions(Options{SourceKey: sourceKey, ProcessingKey: processingKey})
+}
+
+// QueueMiddlewareWithOptions — QueueMiddleware с дополнительными настройками.
+// Если handler не вызвал Ack/Nack сам, задача подтверждается по статусу ответа:
+// 2xx — ack, 5xx или паника — nack; при остальных статусах она остаётся в ProcessingKey,
+// пока её не вернёт Reap по истечении VisibilityTimeout.
+func QueueMiddlewareWithOptions(opts Options) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
-			defer durationHist.Record(r.Context(), time.Since(start).Seconds())
+			defer func() {
+				durationHist.Record(r.Context(), time.Since(start).Seconds())
+			}()
 
-			res, err := queueScript.Run(ctxQueue, redisClientQueue, []string{sourceKey, processingKey}).Result()
+			item, attempt, lane, err := dequeueWait(r.Context(), opts)
+			if err == errInvalidItem {
+				utils.JSON(w, http.StatusInternalServerError, map[string]string{
+					"error": "invalid item type",
+				})
+				return
+			}
 			if err != nil {
 				next.ServeHTTP(w, r)
 				return
 			}
 
-			if res == nil {
+			if item == "" {
+				// У 204 не бывает тела
 				emptyCounter.Add(r.Context(), 1)
-				utils.JSON(w, http.StatusNoContent, map[string]string{
-					"error": "queue is empty",
-				})
+				w.WriteHeader(http.StatusNoContent)
 				return
 			}
 
-			item, ok := res.(string)
-			if !ok {
-				utils.JSON(w, http.StatusInternalServerError, map[string]string{
-					"error": "invalid item type",
-				})
-				return
+			if opts.ExposeHeader {
+				w.Header().Set("X-Queue-Item", item)
 			}
-
-			w.Header().Set("X-Queue-Item", item)
 			processedCounter.Add(r.Context(), 1)
 
-			next.ServeHTTP(w, r)
+			listDelivery(item, attempt, lane, opts).serve(next, w, r)
 		})
 	}
 }
+
+// errInvalidItem — скрипт выдачи вернул ответ неожиданного вида.
+var errInvalidItem = errors.New("invalid item type")
+
+// dequeue берёт задачу из старшей непустой очереди. Возвращает задачу (пусто, если очереди пусты),
+// номер доставки и очередь, из которой она взята.
+func dequeue(opts Options) (string, int64, string, error) {
+	lanes := opts.laneKeys()
+	keys := append(lanes, opts.ProcessingKey, opts.claimsKey(), opts.deliveriesKey(), opts.ticksKey())
+	res, err := queueScript.Run(ctxQueue, redisClientQueue, keys, time.Now().UnixMilli(), opts.starvationEvery()).Result()
+	if err == redis.Nil {
+		return "", 0, "", nil
+	}
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	values, _ := res.([]interface{})
+	if len(values) != 3 {
+		return "", 0, "", errInvalidItem
+	}
+	item, ok := values[0].(string)
+	if !ok {
+		return "", 0, "", errInvalidItem
+	}
+	attempt, _ := values[1].(int64)
+	lane := opts.SourceKey
+	if i, _ := values[2].(int64); i >= 1 && int(i) <= len(lanes) {
+		lane = lanes[i-1]
+	}
+	return item, attempt, lane, nil
+}
+
+// dequeueWait — dequeue, который при пустой очереди ждёт задачу до WaitTimeout,
+// но не дольше, чем жив контекст запроса. Ждём кусками не длиннее blockSlice:
+// блокирующий вызов укладывается в таймаут чтения клиента, а отмена запроса замечается
+// между кусками. Сам вызов идёт не в контексте запроса, поэтому задача, которую Redis
+// выдал к моменту отмены, всё равно доходит до записи о захвате.
+func dequeueWait(ctx context.Context, opts Options) (string, int64, string, error) {
+	item, attempt, lane, err := dequeue(opts)
+	if err != nil || item != "" || opts.WaitTimeout <= 0 {
+		return item, attempt, lane, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.WaitTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	return waitHandoff(ctx, opts, deadline)
+}
+
+// moved — результат BLMOVE из очереди номер lane (с 1) в список ожидающего.
+type moved struct {
+	lane int
+	ok   bool
+	err  error
+}
+
+// waitHandoff ждёт задачу: на каждую очередь (от старшей к младшей) — свой BLMOVE в отдельный
+// список ожидающего, откуда handoffScript атомарно переводит задачу в работу с записью о захвате.
+// Задача нигде не бывает только в памяти экземпляра: если он упадёт между BLMOVE и передачей,
+// задача останется в списке ожидающего, а ожидающий — в ZSET waitersKey со старым временем;
+// такие списки Reap возвращает в очереди. Задачи, которые BLMOVE других очередей перенесли
+// после того, как ожидающий уже получил свою, releaseHandoffScript возвращает обратно,
+// когда эти вызовы завершатся (не позже чем через blockSlice).
+func waitHandoff(ctx context.Context, opts Options, deadline time.Time) (string, int64, string, error) {
+	token, err := newTaskID()
+	if err != nil {
+		return "", 0, "", err
+	}
+	lanes := opts.laneKeys()
+	release := func() {
+		releaseHandoffScript.Run(ctxQueue, redisClientQueue, append([]string{opts.waitersKey()}, lanes...),
+			opts.handoffPrefix(), token)
+	}
+
+	for {
+		remaining := time.Until(deadline)
+		if ctx.Err() != nil || remaining <= 0 {
+			release()
+			return "", 0, "", nil
+		}
+		if err := redisClientQueue.ZAdd(ctxQueue, opts.waitersKey(), &redis.Z{
+			Score: float64(time.Now().UnixMilli()), Member: token,
+		}).Err(); err != nil {
+			release()
+			return "", 0, "", err
+		}
+
+		timeout := strconv.FormatFloat(minDuration(remaining, blockSlice).Seconds(), 'f', 3, 64)
+		results := make(chan moved, len(lanes))
+		for i, lane := range lanes {
+			go func(i int, lane string) {
+				err := redisClientQueue.Do(ctxQueue, "BLMOVE", lane, opts.handoffKey(token, i+1), "RIGHT", "LEFT", timeout).Err()
+				if err == redis.Nil {
+					results <- moved{lane: i + 1}
+					return
+				}
+				results <- moved{lane: i + 1, ok: err == nil, err: err}
+			}(i, lane)
+		}
+
+		var got *moved
+		var failed error
+		pending := len(lanes)
+		for pending > 0 && got == nil {
+			m := <-results
+			pending--
+			switch {
+			case m.ok:
+				got = &m
+			case m.err != nil:
+				failed = m.err
+			}
+		}
+		// Остальные BLMOVE ещё блокируются: когда они завершатся, всё, что они успели
+		// перенести, вернётся в очереди
+		finish := func() {
+			for ; pending > 0; pending-- {
+				<-results
+			}
+			release()
+		}
+
+		if got == nil {
+			if failed != nil {
+				finish()
+				return "", 0, "", failed
+			}
+			continue
+		}
+
+		res, err := handoffScript.Run(ctxQueue, redisClientQueue,
+			[]string{opts.handoffKey(token, got.lane), opts.ProcessingKey, opts.claimsKey(), opts.deliveriesKey()},
+			time.Now().UnixMilli()).Result()
+		go finish()
+		if err == redis.Nil {
+			return "", 0, "", nil
+		}
+		if err != nil {
+			return "", 0, "", err
+		}
+		values, _ := res.([]interface{})
+		if len(values) != 2 {
+			return "", 0, "", errInvalidItem
+		}
+		item, ok := values[0].(string)
+		if !ok {
+			return "", 0, "", errInvalidItem
+		}
+		attempt, _ := values[1].(int64)
+		return item, attempt, lanes[got.lane-1], nil
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
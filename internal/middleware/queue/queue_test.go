@@ -0,0 +1,501 @@
+package queue
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestQueueMiddlewareAckNack(t *testing.T) {
+	if err := InitRedisQueue("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := Options{SourceKey: "queue:test:tasks", ProcessingKey: "queue:test:inprogress", RetryKey: "queue:test:retry"}
+	redisClientQueue.Del(ctxQueue, opts.SourceKey, opts.ProcessingKey, opts.RetryKey)
+
+	status := http.StatusOK
+	handler := QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, status, map[string]string{"status": "done"})
+	}))
+	serve := func() int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/process", nil))
+		return w.Code
+	}
+
+	// 1. 2xx — задача подтверждена и удалена из списка в работе
+	redisClientQueue.LPush(ctxQueue, opts.SourceKey, "task-1")
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if n, _ := redisClientQueue.LLen(ctxQueue, opts.ProcessingKey).Result(); n != 0 {
+		t.Errorf("expected processing list to be empty after ack, got %d", n)
+	}
+
+	// 2. 5xx — задача уходит в список повторов
+	status = http.StatusInternalServerError
+	redisClientQueue.LPush(ctxQueue, opts.SourceKey, "task-2")
+	serve()
+	if items, _ := redisClientQueue.LRange(ctxQueue, opts.RetryKey, 0, -1).Result(); len(items) != 1 || items[0] != "task-2" {
+		t.Errorf("expected task-2 in retry list, got %v", items)
+	}
+	if n, _ := redisClientQueue.LLen(ctxQueue, opts.ProcessingKey).Result(); n != 0 {
+		t.Errorf("expected processing list to be empty after nack, got %d", n)
+	}
+
+	// 3. Паника — задача возвращается, паника идёт дальше
+	redisClientQueue.Del(ctxQueue, opts.RetryKey)
+	panicking := QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	redisClientQueue.LPush(ctxQueue, opts.SourceKey, "task-3")
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic to propagate")
+			}
+		}()
+		panicking.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/process", nil))
+	}()
+	if n, _ := redisClientQueue.LLen(ctxQueue, opts.RetryKey).Result(); n != 1 {
+		t.Errorf("expected panicked task in retry list, got %d", n)
+	}
+
+	// 4. Явный Ack имеет приоритет над статусом ответа
+	redisClientQueue.Del(ctxQueue, opts.RetryKey)
+	explicit := QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := Ack(r.Context()); err != nil {
+			t.Errorf("ack failed: %v", err)
+		}
+		utils.JSON(w, http.StatusInternalServerError, map[string]string{"error": "reported after ack"})
+	}))
+	redisClientQueue.LPush(ctxQueue, opts.SourceKey, "task-4")
+	explicit.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/process", nil))
+	if n, _ := redisClientQueue.LLen(ctxQueue, opts.RetryKey).Result(); n != 0 {
+		t.Errorf("expected explicitly acked task not to be retried, got %d", n)
+	}
+	if n, _ := redisClientQueue.LLen(ctxQueue, opts.ProcessingKey).Result(); n != 0 {
+		t.Errorf("expected processing list to be empty, got %d", n)
+	}
+
+	// 5. Без задачи в контексте
+	if err := Ack(httptest.NewRequest(http.MethodGet, "/", nil).Context()); err != ErrNoDelivery {
+		t.Errorf("expected ErrNoDelivery, got %v", err)
+	}
+}
+
+func TestReapAndDeadLetter(t *testing.T) {
+	if err := InitRedisQueue("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := Options{
+		SourceKey:         "queue:test:reap",
+		ProcessingKey:     "queue:test:reap:inprogress",
+		VisibilityTimeout: 50 * time.Millisecond,
+		MaxDeliveries:     2,
+	}
+	redisClientQueue.Del(ctxQueue, opts.SourceKey, opts.ProcessingKey, opts.claimsKey(), opts.deliveriesKey(), opts.deadLetterKey())
+
+	// Handler "зависает": отвечает 409, задача остаётся в работе без подтверждения
+	handler := QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusConflict, map[string]string{"error": "stuck"})
+	}))
+	claim := func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/process", nil))
+	}
+
+	redisClientQueue.LPush(ctxQueue, opts.SourceKey, "task-1")
+	claim()
+
+	// 1. До истечения visibility timeout задача не трогается
+	if requeued, dead, err := Reap(ctxQueue, opts); err != nil || requeued != 0 || dead != 0 {
+		t.Fatalf("expected nothing to reap yet, got %d/%d err=%v", requeued, dead, err)
+	}
+
+	// 2. После — возвращается в очередь
+	time.Sleep(100 * time.Millisecond)
+	if requeued, _, _ := Reap(ctxQueue, opts); requeued != 1 {
+		t.Fatalf("expected 1 requeued item, got %d", requeued)
+	}
+	if n, _ := redisClientQueue.LLen(ctxQueue, opts.SourceKey).Result(); n != 1 {
+		t.Errorf("expected item back in source queue, got %d", n)
+	}
+
+	// 3. Вторая доставка исчерпывает MaxDeliveries — задача уходит в DLQ
+	claim()
+	time.Sleep(100 * time.Millisecond)
+	if _, dead, _ := Reap(ctxQueue, opts); dead != 1 {
+		t.Fatalf("expected 1 dead-lettered item, got %d", dead)
+	}
+
+	// 4. Админский endpoint: список, возврат в очередь, очистка
+	admin := DeadLetterHandler(opts)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/queue/dlq", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"task-1"`) {
+		t.Errorf("expected DLQ listing with task-1, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/queue/dlq", strings.NewReader(`{"items":["task-1"]}`)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"requeued":1`) {
+		t.Errorf("expected task-1 to be requeued, got %d %s", w.Code, w.Body.String())
+	}
+	if n, _ := redisClientQueue.LLen(ctxQueue, opts.SourceKey).Result(); n != 1 {
+		t.Errorf("expected requeued item in source queue, got %d", n)
+	}
+
+	redisClientQueue.LPush(ctxQueue, opts.deadLetterKey(), "task-2", "task-3")
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/queue/dlq", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"purged":2`) {
+		t.Errorf("expected 2 purged items, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStreamMiddleware(t *testing.T) {
+	if err := InitRedisQueue("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := StreamOptions{
+		Stream:        "queue:test:stream",
+		Group:         "workers",
+		Consumer:      "worker-1",
+		MinIdle:       50 * time.Millisecond,
+		MaxDeliveries: 2,
+	}
+	redisClientQueue.Del(ctxQueue, opts.Stream, opts.deadLetterStream())
+
+	status := http.StatusOK
+	var got string
+	handler := StreamMiddleware(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, ok := StreamMessage(r.Context())
+		if !ok {
+			t.Fatalf("expected stream message in context")
+		}
+		got, _ = msg.Values["task"].(string)
+		utils.JSON(w, status, map[string]string{"status": "done"})
+	}))
+	serve := func() int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/process", nil))
+		return w.Code
+	}
+
+	// 1. Пустой поток
+	if code := serve(); code != http.StatusNoContent {
+		t.Fatalf("expected 204 for empty stream, got %d", code)
+	}
+
+	// 2. 2xx — XACK, pending пуст
+	redisClientQueue.XAdd(ctxQueue, &redis.XAddArgs{Stream: opts.Stream, Values: map[string]interface{}{"task": "task-1"}})
+	if code := serve(); code != http.StatusOK || got != "task-1" {
+		t.Fatalf("expected task-1 with 200, got %q %d", got, code)
+	}
+	if p, _ := redisClientQueue.XPending(ctxQueue, opts.Stream, opts.Group).Result(); p.Count != 0 {
+		t.Errorf("expected no pending entries after ack, got %d", p.Count)
+	}
+
+	// 3. 5xx — запись остаётся в pending и перехватывается другим потребителем после MinIdle
+	status = http.StatusInternalServerError
+	redisClientQueue.XAdd(ctxQueue, &redis.XAddArgs{Stream: opts.Stream, Values: map[string]interface{}{"task": "task-2"}})
+	serve()
+	if p, _ := redisClientQueue.XPending(ctxQueue, opts.Stream, opts.Group).Result(); p.Count != 1 {
+		t.Fatalf("expected 1 pending entry after nack, got %d", p.Count)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	got = ""
+	other := StreamMiddleware(StreamOptions{Stream: opts.Stream, Group: opts.Group, Consumer: "worker-2", MinIdle: opts.MinIdle, MaxDeliveries: opts.MaxDeliveries})
+	w := httptest.NewRecorder()
+	other(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, _ := StreamMessage(r.Context())
+		got, _ = msg.Values["task"].(string)
+		utils.JSON(w, http.StatusInternalServerError, map[string]string{"error": "failed again"})
+	})).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/process", nil))
+	if got != "task-2" {
+		t.Fatalf("expected idle task-2 to be claimed, got %q", got)
+	}
+
+	// 4. Вторая неудачная доставка исчерпывает MaxDeliveries — запись в dead-letter stream
+	if n, _ := redisClientQueue.XLen(ctxQueue, opts.deadLetterStream()).Result(); n != 1 {
+		t.Errorf("expected 1 dead-lettered entry, got %d", n)
+	}
+	if p, _ := redisClientQueue.XPending(ctxQueue, opts.Stream, opts.Group).Result(); p.Count != 0 {
+		t.Errorf("expected no pending entries after dead-lettering, got %d", p.Count)
+	}
+}
+
+func TestItemFromContext(t *testing.T) {
+	if err := InitRedisQueue("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := Options{SourceKey: "queue:test:items", ProcessingKey: "queue:test:items:inprogress"}
+	redisClientQueue.Del(ctxQueue, opts.SourceKey, opts.ProcessingKey, opts.claimsKey(), opts.deliveriesKey())
+
+	var item Item
+	handler := QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		if item, ok = ItemFromContext(r.Context()); !ok {
+			t.Fatalf("expected item in context")
+		}
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "done"})
+	}))
+
+	// 1. Задача в конверте: ID, payload и время постановки из конверта
+	redisClientQueue.LPush(ctxQueue, opts.SourceKey, `{"id":"t-1","payload":{"n":1},"enqueued_at":"2024-01-02T03:04:05Z"}`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/process", nil))
+	if item.ID != "t-1" || string(item.Payload) != `{"n":1}` || item.Attempt != 1 {
+		t.Errorf("unexpected item %+v", item)
+	}
+	if !item.EnqueuedAt.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("unexpected enqueue time %v", item.EnqueuedAt)
+	}
+	var payload struct{ N int }
+	if err := item.Decode(&payload); err != nil || payload.N != 1 {
+		t.Errorf("expected decoded payload n=1, got %+v err=%v", payload, err)
+	}
+	// По умолчанию задача клиенту не отдаётся
+	if h := w.Header().Get("X-Queue-Item"); h != "" {
+		t.Errorf("expected no X-Queue-Item header, got %q", h)
+	}
+
+	// 2. "Голая" задача без конверта
+	redisClientQueue.LPush(ctxQueue, opts.SourceKey, "plain-task")
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/process", nil))
+	if item.ID != "" || string(item.Payload) != "plain-task" || item.Value != nil {
+		t.Errorf("unexpected raw item %+v", item)
+	}
+
+	// 3. ExposeHeader возвращает старое поведение
+	opts.ExposeHeader = true
+	exposed := QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "done"})
+	}))
+	redisClientQueue.LPush(ctxQueue, opts.SourceKey, "visible-task")
+	w = httptest.NewRecorder()
+	exposed.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/process", nil))
+	if h := w.Header().Get("X-Queue-Item"); h != "visible-task" {
+		t.Errorf("expected X-Queue-Item header, got %q", h)
+	}
+}
+
+func TestProducer(t *testing.T) {
+	if err := InitRedisQueue("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	p := NewProducer("queue:test:produced")
+	redisClientQueue.Del(ctxQueue, p.Queue, p.delayedKey(), p.dedupKey("order-1"))
+	ctx := httptest.NewRequest(http.MethodPost, "/", nil).Context()
+
+	// 1. Обычная и срочная задачи: срочная выдаётся первой
+	id1, err := p.Enqueue(ctx, map[string]int{"n": 1}, EnqueueOptions{})
+	if err != nil || id1 == "" {
+		t.Fatalf("enqueue failed: id=%q err=%v", id1, err)
+	}
+	id2, _ := p.Enqueue(ctx, map[string]int{"n": 2}, EnqueueOptions{ID: "urgent", Priority: 1})
+	if id2 != "urgent" {
+		t.Errorf("expected explicit ID, got %q", id2)
+	}
+	next, _ := redisClientQueue.LIndex(ctxQueue, p.Queue, -1).Result()
+	if it := listItem(next, 1); it.ID != "urgent" {
+		t.Errorf("expected urgent task to be dequeued first, got %q", it.ID)
+	}
+
+	// 2. Дедупликация возвращает ID первой задачи
+	first, _ := p.Enqueue(ctx, map[string]int{"n": 3}, EnqueueOptions{DedupKey: "order-1"})
+	dup, err := p.Enqueue(ctx, map[string]int{"n": 3}, EnqueueOptions{DedupKey: "order-1"})
+	if err != ErrDuplicate || dup != first {
+		t.Errorf("expected ErrDuplicate with id %q, got %q err=%v", first, dup, err)
+	}
+
+	// 3. Отложенная задача попадает в очередь только после наступления срока
+	redisClientQueue.Del(ctxQueue, p.Queue)
+	p.Enqueue(ctx, map[string]int{"n": 4}, EnqueueOptions{Delay: 50 * time.Millisecond})
+	if n, _ := p.Promote(ctx); n != 0 {
+		t.Errorf("expected no due tasks yet, got %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n, _ := p.Promote(ctx); n != 1 {
+		t.Errorf("expected 1 promoted task, got %d", n)
+	}
+	if n, _ := redisClientQueue.LLen(ctxQueue, p.Queue).Result(); n != 1 {
+		t.Errorf("expected promoted task in queue, got %d", n)
+	}
+
+	// 4. HTTP endpoint
+	handler := EnqueueHandler(p)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/enqueue", strings.NewReader(`{"email":"a@b.c"}`)))
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"id"`) {
+		t.Errorf("expected 202 with id, got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/enqueue", strings.NewReader(`{broken`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid JSON, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/enqueue?delay=soon", strings.NewReader(`{}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid delay, got %d", w.Code)
+	}
+}
+
+func TestPriorityLanes(t *testing.T) {
+	if err := InitRedisQueue("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := Options{SourceKey: "queue:test:lanes", ProcessingKey: "queue:test:lanes:inprogress", Priorities: 3, StarvationEvery: 3}
+	p := &Producer{Queue: opts.SourceKey, Priorities: opts.Priorities}
+	keys := append(opts.laneKeys(), opts.ProcessingKey, opts.claimsKey(), opts.deliveriesKey(), opts.ticksKey(), p.delayedKey())
+	redisClientQueue.Del(ctxQueue, keys...)
+	ctx := httptest.NewRequest(http.MethodPost, "/", nil).Context()
+
+	for i := 0; i < 5; i++ {
+		p.Enqueue(ctx, i, EnqueueOptions{ID: "high-" + strconv.Itoa(i), Priority: 2})
+	}
+	p.Enqueue(ctx, 0, EnqueueOptions{ID: "mid", Priority: 1})
+	p.Enqueue(ctx, 0, EnqueueOptions{ID: "low"})
+	// Приоритет выше числа очередей попадает в старшую очередь
+	p.Enqueue(ctx, 0, EnqueueOptions{ID: "high-5", Priority: 9})
+
+	var got []string
+	handler := QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		item, _ := ItemFromContext(r.Context())
+		got = append(got, item.ID)
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "done"})
+	}))
+	for i := 0; i < 8; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/process", nil))
+	}
+
+	// Старшая очередь первой, но каждая третья выдача — из младших очередей по кругу
+	want := []string{"high-0", "high-1", "low", "high-2", "high-3", "mid", "high-4", "high-5"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected dequeue order:\n got %v\nwant %v", got, want)
+	}
+
+	// Отложенная задача переносится в очередь своего приоритета
+	p.Enqueue(ctx, 0, EnqueueOptions{ID: "delayed-mid", Priority: 1, At: time.Now().Add(-time.Second)})
+	if n, _ := p.Promote(ctx); n != 1 {
+		t.Fatalf("expected 1 promoted task, got %d", n)
+	}
+	if n, _ := redisClientQueue.LLen(ctxQueue, laneKey(opts.SourceKey, 3, 1)).Result(); n != 1 {
+		t.Errorf("expected delayed task in priority 1 lane, got %d", n)
+	}
+}
+
+func TestLongPolling(t *testing.T) {
+	if err := InitRedisQueue("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := Options{SourceKey: "queue:test:poll", ProcessingKey: "queue:test:poll:inprogress", WaitTimeout: 2 * time.Second}
+	redisClientQueue.Del(ctxQueue, opts.SourceKey, opts.ProcessingKey, opts.claimsKey(), opts.deliveriesKey())
+
+	handler := QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		item, _ := ItemFromContext(r.Context())
+		utils.JSON(w, http.StatusOK, map[string]string{"task": string(item.Payload)})
+	}))
+
+	// 1. Задача, поставленная во время ожидания, выдаётся тому же запросу
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		redisClientQueue.LPush(ctxQueue, opts.SourceKey, "late-task")
+	}()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/process", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "late-task") {
+		t.Fatalf("expected late-task to be delivered, got %d %s", w.Code, w.Body.String())
+	}
+	if n, _ := redisClientQueue.ZCard(ctxQueue, opts.claimsKey()).Result(); n != 0 {
+		t.Errorf("expected claim to be removed after ack, got %d", n)
+	}
+
+	// 2. Очередь пуста — по истечении WaitTimeout 204 без тела
+	opts.WaitTimeout = 300 * time.Millisecond
+	handler = QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler must not be called for empty queue")
+	}))
+	start := time.Now()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/process", nil))
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("expected empty 204, got %d %q", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("expected to wait for WaitTimeout, returned after %v", elapsed)
+	}
+
+	// 3. Задача, застрявшая в списке ожидающего (экземпляр упал между BLMOVE и передачей), возвращается Reap
+	redisClientQueue.ZAdd(ctxQueue, opts.waitersKey(), &redis.Z{Score: 1, Member: "crashed"})
+	redisClientQueue.LPush(ctxQueue, opts.handoffKey("crashed", 1), "orphan")
+	if requeued, _, err := Reap(ctxQueue, opts); err != nil || requeued != 1 {
+		t.Errorf("expected orphan to be requeued, got %d %v", requeued, err)
+	}
+	if items, _ := redisClientQueue.LRange(ctxQueue, opts.SourceKey, 0, -1).Result(); len(items) != 1 || items[0] != "orphan" {
+		t.Errorf("expected orphan back in queue, got %v", items)
+	}
+	if n, _ := redisClientQueue.ZCard(ctxQueue, opts.waitersKey()).Result(); n != 0 {
+		t.Errorf("expected crashed waiter to be removed, got %d", n)
+	}
+	redisClientQueue.Del(ctxQueue, opts.SourceKey)
+
+	// 4. С приоритетами ожидание блокирующее по всем очередям, задача сразу числится захваченной
+	opts = Options{SourceKey: "queue:test:poll:lanes", ProcessingKey: "queue:test:poll:lanes:inprogress", Priorities: 2, WaitTimeout: 2 * time.Second}
+	redisClientQueue.Del(ctxQueue, append(opts.laneKeys(), opts.ProcessingKey, opts.claimsKey(), opts.deliveriesKey())...)
+	var claimed int64
+	handler = QueueMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claimed, _ = redisClientQueue.ZCard(ctxQueue, opts.claimsKey()).Result()
+		item, _ := ItemFromContext(r.Context())
+		utils.JSON(w, http.StatusOK, map[string]string{"task": string(item.Payload)})
+	}))
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		redisClientQueue.LPush(ctxQueue, laneKey(opts.SourceKey, opts.Priorities, 1), "urgent-task")
+	}()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/process", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "urgent-task") {
+		t.Fatalf("expected urgent-task to be delivered, got %d %s", w.Code, w.Body.String())
+	}
+	if claimed != 1 {
+		t.Errorf("expected task to be claimed while processed, got %d claims", claimed)
+	}
+
+	// Задача, которую BLMOVE младшей очереди перенёс уже после выдачи, возвращается в очередь,
+	// а ожидающий снимается с учёта, когда его блокирующие вызовы завершатся
+	redisClientQueue.LPush(ctxQueue, opts.SourceKey, "late-low-task")
+	time.Sleep(blockSlice + 200*time.Millisecond)
+	if n, _ := redisClientQueue.ZCard(ctxQueue, opts.waitersKey()).Result(); n != 0 {
+		t.Errorf("expected waiter to be released, got %d", n)
+	}
+	if items, _ := redisClientQueue.LRange(ctxQueue, opts.SourceKey, 0, -1).Result(); len(items) != 1 || items[0] != "late-low-task" {
+		t.Errorf("expected late-low-task back in its queue, got %v", items)
+	}
+	redisClientQueue.Del(ctxQueue, opts.SourceKey)
+
+	// 5. Потребитель упал между BLMOVE приоритетной очереди и передачей задачи в работу:
+	// задача не теряется, Reap возвращает её в ту же очередь, и её получает следующий запрос
+	urgent := laneKey(opts.SourceKey, opts.Priorities, 1)
+	redisClientQueue.LPush(ctxQueue, urgent, "crashed-task")
+	redisClientQueue.ZAdd(ctxQueue, opts.waitersKey(), &redis.Z{Score: 1, Member: "dead-consumer"})
+	if err := redisClientQueue.Do(ctxQueue, "BLMOVE", urgent, opts.handoffKey("dead-consumer", 1), "RIGHT", "LEFT", "0.1").Err(); err != nil {
+		t.Fatalf("failed to move task: %v", err)
+	}
+	if requeued, _, err := Reap(ctxQueue, opts); err != nil || requeued != 1 {
+		t.Fatalf("expected crashed-task to be requeued, got %d %v", requeued, err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/process", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "crashed-task") {
+		t.Fatalf("expected crashed-task to be redelivered, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,266 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// defaultStreamMinIdle — через сколько неподтверждённая запись считается брошенной
+// и может быть перехвачена другим потребителем.
+const defaultStreamMinIdle = 30 * time.Second
+
+// StreamOptions — настройки StreamMiddleware.
+type StreamOptions struct {
+	// Stream — ключ Redis Stream с задачами (производители делают XADD).
+	Stream string
+	// Group — consumer group; создаётся при первом запросе, если её нет.
+	Group string
+	// Consumer — имя потребителя в группе. Пусто — <hostname>-<pid>.
+	Consumer string
+	// MinIdle — сколько запись может висеть в pending у потребителя без XACK,
+	// прежде чем её перехватит другой (XAUTOCLAIM). 0 — defaultStreamMinIdle.
+	MinIdle time.Duration
+	// MaxDeliveries — после стольких доставок запись уходит в DeadLetterStream (0 — без ограничения).
+	MaxDeliveries int
+	// DeadLetterStream — поток "мёртвых" записей. Пусто — <Stream>:dead.
+	DeadLetterStream string
+	// WaitTimeout — сколько ждать новую запись, если поток пуст (XREADGROUP BLOCK). 0 — сразу 204.
+	// Ожидание также ограничено контекстом запроса.
+	WaitTimeout time.Duration
+}
+
+func (opts StreamOptions) consumer() string {
+	if opts.Consumer != "" {
+		return opts.Consumer
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func (opts StreamOptions) minIdle() time.Duration {
+	if opts.MinIdle > 0 {
+		return opts.MinIdle
+	}
+	return defaultStreamMinIdle
+}
+
+func (opts StreamOptions) deadLetterStream() string {
+	if opts.DeadLetterStream != "" {
+		return opts.DeadLetterStream
+	}
+	return opts.Stream + ":dead"
+}
+
+type streamMessageContextKey struct{}
+
+// StreamMessage возвращает запись потока, выданную текущему запросу StreamMiddleware.
+func StreamMessage(ctx context.Context) (redis.XMessage, bool) {
+	msg, ok := ctx.Value(streamMessageContextKey{}).(redis.XMessage)
+	return msg, ok
+}
+
+// StreamMiddleware — бэкенд очереди на Redis Streams и consumer groups.
+// На каждый запрос берётся одна запись: сначала перехватывается брошенная
+// (pending дольше MinIdle у упавшего потребителя, XAUTOCLAIM), иначе читается новая (XREADGROUP).
+// Задача доступна handler'у через ItemFromContext, исходные поля записи — через StreamMessage.
+//
+// Подтверждение — как у QueueMiddleware: 2xx или Ack — XACK; 5xx, паника или Nack оставляют
+// запись в pending, и её повторно доставят после MinIdle. Запись, доставленная
+// MaxDeliveries раз, при nack или повторном перехвате переносится в DeadLetterStream.
+func StreamMiddleware(opts StreamOptions) func(http.Handler) http.Handler {
+	consumer := opts.consumer()
+	var groupMu sync.Mutex
+	groupReady := false
+
+	ensureGroup := func() error {
+		groupMu.Lock()
+		defer groupMu.Unlock()
+		if groupReady {
+			return nil
+		}
+		err := redisClientQueue.XGroupCreateMkStream(ctxQueue, opts.Stream, opts.Group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+		groupReady = true
+		return nil
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			defer func() {
+				durationHist.Record(r.Context(), time.Since(start).Seconds())
+			}()
+
+			if err := ensureGroup(); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			msg, deliveries, err := nextStreamMessage(r.Context(), opts, consumer)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if msg == nil {
+				emptyCounter.Add(r.Context(), 1)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			processedCounter.Add(r.Context(), 1)
+			d := &delivery{
+				item: streamItem(*msg, deliveries),
+				ack: func(ctx context.Context) error {
+					return redisClientQueue.XAck(ctxQueue, opts.Stream, opts.Group, msg.ID).Err()
+				},
+				nack: func(ctx context.Context) error {
+					if opts.MaxDeliveries > 0 && deliveries >= int64(opts.MaxDeliveries) {
+						return deadLetterStream(ctx, opts, *msg)
+					}
+					// Запись остаётся в pending и будет перехвачена после MinIdle
+					return nil
+				},
+			}
+			r = r.WithContext(context.WithValue(r.Context(), streamMessageContextKey{}, *msg))
+			d.serve(next, w, r)
+		})
+	}
+}
+
+// nextStreamMessage возвращает брошенную запись или новую, а также номер её доставки.
+// Записи, исчерпавшие MaxDeliveries, по пути переносятся в DeadLetterStream.
+func nextStreamMessage(ctx context.Context, opts StreamOptions, consumer string) (*redis.XMessage, int64, error) {
+	for {
+		msg, err := autoClaim(opts, consumer)
+		if err != nil {
+			return nil, 0, err
+		}
+		if msg == nil {
+			break
+		}
+
+		deliveries := int64(1)
+		pending, err := redisClientQueue.XPendingExt(ctxQueue, &redis.XPendingExtArgs{
+			Stream: opts.Stream,
+			Group:  opts.Group,
+			Start:  msg.ID,
+			End:    msg.ID,
+			Count:  1,
+		}).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(pending) == 1 {
+			deliveries = pending[0].RetryCount
+		}
+
+		// Запись уже доставлялась MaxDeliveries раз и снова брошена — в DLQ
+		if opts.MaxDeliveries > 0 && deliveries > int64(opts.MaxDeliveries) {
+			if err := deadLetterStream(ctx, opts, *msg); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		reapedCounter.Add(ctx, 1)
+		return msg, deliveries, nil
+	}
+
+	// Без ожидания Block: -1 (0 у XREADGROUP означает "ждать вечно")
+	block := time.Duration(-1)
+	if opts.WaitTimeout > 0 {
+		block = opts.WaitTimeout
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < block {
+			block = time.Until(deadline)
+		}
+		if block < time.Millisecond {
+			return nil, 0, nil
+		}
+	}
+	streams, err := redisClientQueue.XReadGroup(ctxQueue, &redis.XReadGroupArgs{
+		Group:    opts.Group,
+		Consumer: consumer,
+		Streams:  []string{opts.Stream, ">"},
+		Count:    1,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(streams) == 0 || len(streams[0].Messages) == 0 {
+		return nil, 0, nil
+	}
+	return &streams[0].Messages[0], 1, nil
+}
+
+// autoClaim перехватывает одну запись, простаивающую в pending дольше MinIdle.
+// XAUTOCLAIM вызывается через Do: ответ Redis 7 содержит третий элемент
+// (удалённые ID), который типизированная команда go-redis v8 не разбирает.
+func autoClaim(opts StreamOptions, consumer string) (*redis.XMessage, error) {
+	res, err := redisClientQueue.Do(ctxQueue, "XAUTOCLAIM", opts.Stream, opts.Group, consumer,
+		opts.minIdle().Milliseconds(), "0-0", "COUNT", 1).Result()
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := res.([]interface{})
+	if !ok || len(reply) < 2 {
+		return nil, fmt.Errorf("unexpected XAUTOCLAIM reply: %v", res)
+	}
+	entries, _ := reply[1].([]interface{})
+	for _, entry := range entries {
+		// Redis 6.2 возвращает nil вместо записей, удалённых из потока
+		if msg, ok := parseXMessage(entry); ok {
+			return &msg, nil
+		}
+	}
+	return nil, nil
+}
+
+func parseXMessage(entry interface{}) (redis.XMessage, bool) {
+	parts, ok := entry.([]interface{})
+	if !ok || len(parts) != 2 {
+		return redis.XMessage{}, false
+	}
+	id, _ := parts[0].(string)
+	rawFields, _ := parts[1].([]interface{})
+	if id == "" || rawFields == nil {
+		return redis.XMessage{}, false
+	}
+	values := make(map[string]interface{}, len(rawFields)/2)
+	for i := 0; i+1 < len(rawFields); i += 2 {
+		key, _ := rawFields[i].(string)
+		values[key] = rawFields[i+1]
+	}
+	return redis.XMessage{ID: id, Values: values}, true
+}
+
+// deadLetterStream копирует запись в DeadLetterStream (с исходным ID в поле source_id)
+// и подтверждает её в исходной группе.
+func deadLetterStream(ctx context.Context, opts StreamOptions, msg redis.XMessage) error {
+	values := make(map[string]interface{}, len(msg.Values)+1)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["source_id"] = msg.ID
+
+	_, err := redisClientQueue.TxPipelined(ctxQueue, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctxQueue, &redis.XAddArgs{Stream: opts.deadLetterStream(), Values: values})
+		pipe.XAck(ctxQueue, opts.Stream, opts.Group, msg.ID)
+		return nil
+	})
+	if err == nil {
+		deadCounter.Add(ctx, 1)
+	}
+	return err
+}
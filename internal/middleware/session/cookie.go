@@ -0,0 +1,199 @@
+package session
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxCookieSize — предел размера cookie, который гарантированно принимают браузеры.
+const maxCookieSize = 4096
+
+// ErrCookieTooLarge — данные сессии не помещаются в cookie.
+var ErrCookieTooLarge = errors.New("session cookie too large")
+
+// cookiePayload — содержимое cookie до шифрования.
+type cookiePayload struct {
+	ID      string          `json:"id"`
+	Data    json.RawMessage `json:"data"`
+	Flash   json.RawMessage `json:"flash"`
+	Created int64           `json:"iat"`
+	Expires int64           `json:"exp"`
+}
+
+// CookieStore хранит данные сессии целиком в cookie, зашифрованной и
+// аутентифицированной AES-GCM. Сервер не хранит состояния.
+//
+// Поддерживается ротация ключей: первый ключ шифрует, все ключи расшифровывают.
+// Cookie, расшифрованная старым ключом, перевыпускается с текущим.
+type CookieStore struct {
+	TTLSec int
+	// MaxLifetimeSec — абсолютное время жизни сессии (0 — без ограничения).
+	MaxLifetimeSec int
+	// Secure выставляет флаг Secure у cookie (только HTTPS).
+	Secure bool
+
+	aeads []cipher.AEAD
+}
+
+// NewCookieStore создаёт cookie-бэкенд сессий. Ключи — 16, 24 или 32 байта (AES-128/192/256).
+func NewCookieStore(ttlSec int, keys ...[]byte) (*CookieStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one session key is required")
+	}
+
+	st := &CookieStore{TTLSec: ttlSec}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session key %d: %w", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session key %d: %w", i, err)
+		}
+		st.aeads = append(st.aeads, aead)
+	}
+	return st, nil
+}
+
+// ParseKeys разбирает список ключей в base64 через запятую (например, из SESSION_KEYS).
+func ParseKeys(s string) ([][]byte, error) {
+	var keys [][]byte
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode session key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (st *CookieStore) Load(ctx context.Context, r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrNoSession
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+
+	var plain []byte
+	keyIndex := -1
+	for i, aead := range st.aeads {
+		if len(raw) < aead.NonceSize() {
+			continue
+		}
+		nonce, sealed := raw[:aead.NonceSize()], raw[aead.NonceSize():]
+		if plain, err = aead.Open(nil, nonce, sealed, []byte(CookieName)); err == nil {
+			keyIndex = i
+			break
+		}
+	}
+	if keyIndex < 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	// Подпись верна, а содержимое не разбирается — это не подделка, а испорченные данные
+	var p cookiePayload
+	if err := json.Unmarshal(plain, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSession, err)
+	}
+	remaining := time.Until(time.Unix(p.Expires, 0))
+	if remaining <= 0 {
+		return nil, ErrSessionNotFound
+	}
+	created := time.Unix(p.Created, 0)
+	if st.MaxLifetimeSec > 0 && time.Since(created) >= time.Duration(st.MaxLifetimeSec)*time.Second {
+		return nil, ErrSessionNotFound
+	}
+
+	s := newSession(p.ID)
+	s.CreatedAt = created
+	if err := s.decode(string(p.Data), string(p.Flash)); err != nil {
+		return nil, err
+	}
+
+	// Продлеваем сессию, когда прошла половина TTL, и перешифровываем cookie
+	// текущим ключом после ротации.
+	if keyIndex > 0 || remaining < time.Duration(st.TTLSec)*time.Second/2 {
+		s.dirty = true
+	}
+	return s, nil
+}
+
+func (st *CookieStore) Save(ctx context.Context, w http.ResponseWriter, s *Session) error {
+	data, flash, err := s.encode()
+	if err != nil {
+		return err
+	}
+
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = time.Now()
+	}
+	expires := time.Now().Add(time.Duration(st.TTLSec) * time.Second)
+	if st.MaxLifetimeSec > 0 {
+		if deadline := s.CreatedAt.Add(time.Duration(st.MaxLifetimeSec) * time.Second); deadline.Before(expires) {
+			expires = deadline
+		}
+	}
+
+	plain, err := json.Marshal(cookiePayload{
+		ID:      s.ID,
+		Data:    data,
+		Flash:   flash,
+		Created: s.CreatedAt.Unix(),
+		Expires: expires.Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode session cookie: %w", err)
+	}
+
+	aead := st.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	value := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(CookieName)))
+	if len(value) > maxCookieSize {
+		return ErrCookieTooLarge
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(time.Until(expires).Seconds()),
+		HttpOnly: true,
+		Secure:   st.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (st *CookieStore) Create(ctx context.Context, w http.ResponseWriter) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	s := newSession(id)
+	if err := st.Save(ctx, w, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -2,8 +2,15 @@ package session
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-portfolio/http-middleware/internal/utils"
@@ -12,29 +19,91 @@ import (
 	"go.opentelemetry.io/otel/metric"
 )
 
+// CookieName — имя cookie с идентификатором (или содержимым) сессии.
+const CookieName = "session_id"
+
 var (
 	redisClientSession *redis.Client
 	ctxSession         = context.Background()
 	meter              = otel.Meter("session")
 
-	sessionRenewedCounter   metric.Int64Counter
-	sessionMissingCounter   metric.Int64Counter
-	sessionNotFoundCounter  metric.Int64Counter
-	sessionDurationHist     metric.Float64Histogram
+	sessionRenewedCounter  metric.Int64Counter
+	sessionMissingCounter  metric.Int64Counter
+	sessionNotFoundCounter metric.Int64Counter
+	sessionSavedCounter    metric.Int64Counter
+	sessionDurationHist    metric.Float64Histogram
 
+	// Сессия хранится в хэше: поле data — JSON с данными, flash — JSON со списком flash-сообщений,
+	// created/last_seen/ip/ua/user — метаданные для списка сессий пользователя.
+	// Скрипт проверяет абсолютное время жизни, продлевает idle TTL (не дальше абсолютного предела)
+	// и обновляет метаданные. Индекс сессий пользователя живёт не меньше любой его сессии,
+	// поэтому его TTL продлевается вместе с ней.
 	sessionScript = redis.NewScript(`
-local val = redis.call("GET", KEYS[1])
-if val then
-    redis.call("EXPIRE", KEYS[1], ARGV[1])
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return false
+end
+local ttl = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local maxLife = tonumber(ARGV[3])
+local created = tonumber(redis.call("HGET", KEYS[1], "created") or "0")
+if maxLife > 0 and created > 0 then
+    local left = maxLife - (now - created)
+    if left <= 0 then
+        redis.call("DEL", KEYS[1])
+        return false
+    end
+    if left < ttl then
+        ttl = left
+    end
+end
+redis.call("HSET", KEYS[1], "last_seen", now, "ip", ARGV[4], "ua", ARGV[5])
+redis.call("EXPIRE", KEYS[1], ttl)
+local user = redis.call("HGET", KEYS[1], "user")
+if user and user ~= "" then
+    local index = "user_sessions:" .. user
+    local left = redis.call("TTL", index)
+    if left ~= -2 and left < ttl then
+        redis.call("EXPIRE", index, ttl)
+    end
+end
+return redis.call("HMGET", KEYS[1], "data", "flash", "user", "created")
+`)
+
+	// Сохраняем только существующую сессию, чтобы не воскрешать истёкшую или удалённую.
+	// HSET не трогает TTL, выставленный при загрузке.
+	sessionSaveScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return 0
 end
-return val
+redis.call("HSET", KEYS[1], "data", ARGV[1], "flash", ARGV[2])
+return 1
+`)
+
+	// KEYS[1] — индекс сессий пользователя, ARGV[1] — ID сессии, ARGV[2] — её предельное время жизни
+	// в секундах. TTL индекса только растёт: индекс не должен истечь раньше своих сессий.
+	indexAddScript = redis.NewScript(`
+redis.call("SADD", KEYS[1], ARGV[1])
+if redis.call("TTL", KEYS[1]) < tonumber(ARGV[2]) then
+    redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+return 1
 `)
 )
 
+var (
+	// ErrNoSession — в запросе нет cookie сессии.
+	ErrNoSession = errors.New("missing session_id")
+	// ErrSessionNotFound — сессия неизвестна, истекла или не прошла проверку подписи.
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrInvalidSession — сессия найдена, но её данные не удалось разобрать.
+	ErrInvalidSession = errors.New("invalid session data")
+)
+
 func init() {
 	sessionRenewedCounter, _ = meter.Int64Counter("session_renewed_total")
 	sessionMissingCounter, _ = meter.Int64Counter("session_missing_total")
 	sessionNotFoundCounter, _ = meter.Int64Counter("session_notfound_total")
+	sessionSavedCounter, _ = meter.Int64Counter("session_saved_total")
 	sessionDurationHist, _ = meter.Float64Histogram("session_duration_seconds")
 }
 
@@ -51,40 +120,473 @@ func InitRedisSession(addr, password string, db int) error {
 	return nil
 }
 
+// Store — бэкенд хранения сессий. Handler'ы работают с сессией одинаково
+// независимо от бэкенда, поэтому маршрут может сменить его через конфигурацию.
+type Store interface {
+	// Load загружает сессию запроса. Возвращает ErrNoSession, если cookie нет,
+	// ErrSessionNotFound, если сессия неизвестна или истекла, и ErrInvalidSession,
+	// если её данные не разбираются. Прочие ошибки — недоступность хранилища.
+	Load(ctx context.Context, r *http.Request) (*Session, error)
+	// Save сохраняет изменённую сессию. Вызывается до записи заголовков ответа,
+	// поэтому бэкенд может выставить cookie.
+	Save(ctx context.Context, w http.ResponseWriter, s *Session) error
+	// Create заводит новую пустую сессию и выставляет cookie.
+	Create(ctx context.Context, w http.ResponseWriter) (*Session, error)
+}
+
+// Session — данные сессии, загруженные на время обработки запроса.
+// Значения проходят через JSON, поэтому числа после загрузки приходят как float64.
+type Session struct {
+	ID string
+	// UserID — владелец сессии, если она создана через CreateForUser.
+	UserID string
+	// CreatedAt — время создания сессии, от него считается абсолютное время жизни.
+	CreatedAt time.Time
+
+	mu      sync.Mutex
+	values  map[string]interface{}
+	flashes []string
+	dirty   bool
+}
+
+func newSession(id string) *Session {
+	return &Session{ID: id, values: map[string]interface{}{}}
+}
+
+// Get возвращает значение из сессии.
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set записывает значение в сессию и помечает её изменённой.
+func (s *Session) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	s.dirty = true
+}
+
+// Delete удаляет значение из сессии.
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.values[key]; ok {
+		delete(s.values, key)
+		s.dirty = true
+	}
+}
+
+// AddFlash добавляет flash-сообщение, которое будет доступно в следующем запросе.
+func (s *Session) AddFlash(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flashes = append(s.flashes, msg)
+	s.dirty = true
+}
+
+// Flashes возвращает накопленные flash-сообщения и очищает их.
+func (s *Session) Flashes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flashes := s.flashes
+	if len(flashes) > 0 {
+		s.flashes = nil
+		s.dirty = true
+	}
+	return flashes
+}
+
+// encode сериализует данные и flash-сообщения в JSON.
+func (s *Session) encode() (data, flash []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err = json.Marshal(s.values)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode session data: %w", err)
+	}
+	flashes := s.flashes
+	if flashes == nil {
+		flashes = []string{}
+	}
+	flash, err = json.Marshal(flashes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode session flashes: %w", err)
+	}
+	return data, flash, nil
+}
+
+// decode разбирает JSON с данными и flash-сообщениями.
+func (s *Session) decode(data, flash string) error {
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &s.values); err != nil {
+			return fmt.Errorf("%w: failed to decode data: %v", ErrInvalidSession, err)
+		}
+	}
+	if flash != "" {
+		if err := json.Unmarshal([]byte(flash), &s.flashes); err != nil {
+			return fmt.Errorf("%w: failed to decode flashes: %v", ErrInvalidSession, err)
+		}
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// FromContext возвращает сессию текущего запроса или nil, если middleware не подключён.
+func FromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(contextKey{}).(*Session)
+	return s
+}
+
+// Get возвращает значение из сессии запроса.
+func Get(ctx context.Context, key string) (interface{}, bool) {
+	if s := FromContext(ctx); s != nil {
+		return s.Get(key)
+	}
+	return nil, false
+}
+
+// Set записывает значение в сессию запроса. Сохранение произойдёт перед записью ответа.
+func Set(ctx context.Context, key string, value interface{}) {
+	if s := FromContext(ctx); s != nil {
+		s.Set(key, value)
+	}
+}
+
+// Delete удаляет значение из сессии запроса.
+func Delete(ctx context.Context, key string) {
+	if s := FromContext(ctx); s != nil {
+		s.Delete(key)
+	}
+}
+
+// AddFlash добавляет flash-сообщение в сессию запроса.
+func AddFlash(ctx context.Context, msg string) {
+	if s := FromContext(ctx); s != nil {
+		s.AddFlash(msg)
+	}
+}
+
+// Flashes возвращает и очищает flash-сообщения сессии запроса.
+func Flashes(ctx context.Context) []string {
+	if s := FromContext(ctx); s != nil {
+		return s.Flashes()
+	}
+	return nil
+}
+
+// newSessionID генерирует случайный идентификатор сессии.
+func newSessionID() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Create заводит новую пустую сессию в Redis и возвращает её идентификатор
+// для cookie session_id.
+func Create(ctx context.Context, ttlSec int) (string, error) {
+	return createSession(ctx, ttlSec, 0, "")
+}
+
+// CreateForUser заводит сессию пользователя и добавляет её в индекс user_sessions:<userID>,
+// по которому работают ListSessions и RevokeSession.
+func CreateForUser(ctx context.Context, ttlSec int, userID string) (string, error) {
+	return createSession(ctx, ttlSec, 0, userID)
+}
+
+// createSession заводит сессию. Индекс user_sessions:<userID> получает TTL не меньше
+// абсолютного времени жизни сессии (maxLifetimeSec, а без него — ttlSec) и дальше
+// продлевается при каждом обращении к сессии, так что ID мёртвых сессий не копятся в нём вечно.
+func createSession(ctx context.Context, ttlSec, maxLifetimeSec int, userID string) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	sessionKey := "session:" + id
+	now := time.Now().Unix()
+	_, err = redisClientSession.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sessionKey, "data", "{}", "flash", "[]", "created", now, "last_seen", now, "user", userID)
+		pipe.Expire(ctx, sessionKey, time.Duration(ttlSec)*time.Second)
+		if userID != "" {
+			lifetime := ttlSec
+			if maxLifetimeSec > lifetime {
+				lifetime = maxLifetimeSec
+			}
+			indexAddScript.Eval(ctx, pipe, []string{userSessionsKey(userID)}, id, lifetime)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	return id, nil
+}
+
+func userSessionsKey(userID string) string {
+	return "user_sessions:" + userID
+}
+
+// Info — метаданные активной сессии пользователя.
+type Info struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// ListSessions возвращает активные сессии пользователя.
+// Истёкшие сессии при этом удаляются из индекса.
+func ListSessions(ctx context.Context, userID string) ([]Info, error) {
+	indexKey := userSessionsKey(userID)
+	ids, err := redisClientSession.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Info, 0, len(ids))
+	for _, id := range ids {
+		fields, err := redisClientSession.HMGet(ctx, "session:"+id, "created", "last_seen", "ip", "ua").Result()
+		if err != nil {
+			return nil, err
+		}
+		if fields[0] == nil {
+			redisClientSession.SRem(ctx, indexKey, id)
+			continue
+		}
+
+		info := Info{ID: id}
+		info.CreatedAt = parseUnix(fields[0])
+		info.LastSeen = parseUnix(fields[1])
+		info.IP, _ = fields[2].(string)
+		info.UserAgent, _ = fields[3].(string)
+		sessions = append(sessions, info)
+	}
+	return sessions, nil
+}
+
+// RevokeSession завершает одну сессию пользователя.
+// Чужую или уже завершённую сессию отклоняет с ErrSessionNotFound.
+func RevokeSession(ctx context.Context, userID, sessionID string) error {
+	removed, err := redisClientSession.SRem(ctx, userSessionsKey(userID), sessionID).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrSessionNotFound
+	}
+	return redisClientSession.Del(ctx, "session:"+sessionID).Err()
+}
+
+// RevokeAllSessions завершает все сессии пользователя, кроме перечисленных в keep
+// (например, текущей при смене пароля).
+func RevokeAllSessions(ctx context.Context, userID string, keep ...string) error {
+	indexKey := userSessionsKey(userID)
+	ids, err := redisClientSession.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool, len(keep))
+	for _, id := range keep {
+		kept[id] = true
+	}
+
+	_, err = redisClientSession.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			if kept[id] {
+				continue
+			}
+			pipe.Del(ctx, "session:"+id)
+			pipe.SRem(ctx, indexKey, id)
+		}
+		return nil
+	})
+	return err
+}
+
+func parseUnix(v interface{}) time.Time {
+	s, _ := v.(string)
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// RedisStore хранит сессии в Redis. TTLSec — idle-таймаут, который продлевается
+// при каждом запросе; MaxLifetimeSec — абсолютное время жизни сессии (0 — без ограничения).
+type RedisStore struct {
+	TTLSec         int
+	MaxLifetimeSec int
+}
+
+// NewRedisStore создаёт Redis-бэкенд сессий. Клиент инициализируется через InitRedisSession.
+func NewRedisStore(ttlSec int) *RedisStore {
+	return &RedisStore{TTLSec: ttlSec}
+}
+
+func (st *RedisStore) Load(ctx context.Context, r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrNoSession
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	res, err := sessionScript.Run(ctx, redisClientSession, []string{"session:" + cookie.Value},
+		st.TTLSec, time.Now().Unix(), st.MaxLifetimeSec, ip, r.UserAgent()).Result()
+	if err == redis.Nil {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fields, _ := res.([]interface{})
+	var data, flash string
+	s := newSession(cookie.Value)
+	if len(fields) == 4 {
+		data, _ = fields[0].(string)
+		flash, _ = fields[1].(string)
+		s.UserID, _ = fields[2].(string)
+		s.CreatedAt = parseUnix(fields[3])
+	}
+
+	if err := s.decode(data, flash); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (st *RedisStore) Save(ctx context.Context, w http.ResponseWriter, s *Session) error {
+	data, flash, err := s.encode()
+	if err != nil {
+		return err
+	}
+	return sessionSaveScript.Run(ctx, redisClientSession, []string{"session:" + s.ID}, data, flash).Err()
+}
+
+func (st *RedisStore) Create(ctx context.Context, w http.ResponseWriter) (*Session, error) {
+	return st.CreateForUser(ctx, w, "")
+}
+
+// CreateForUser заводит сессию пользователя и выставляет cookie, например, после логина.
+func (st *RedisStore) CreateForUser(ctx context.Context, w http.ResponseWriter, userID string) (*Session, error) {
+	id, err := createSession(ctx, st.TTLSec, st.MaxLifetimeSec, userID)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	s := newSession(id)
+	s.UserID = userID
+	s.CreatedAt = time.Now()
+	return s, nil
+}
+
+// sessionWriter сохраняет сессию перед первой записью заголовков ответа,
+// чтобы бэкенд успел выставить cookie.
+type sessionWriter struct {
+	http.ResponseWriter
+	commit      func()
+	wroteHeader bool
+}
+
+func (sw *sessionWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		sw.commit()
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *sessionWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// SessionMiddleware проверяет cookie session_id, продлевает TTL сессии в Redis,
+// кладёт её данные в контекст запроса и сохраняет их, если handler их изменил.
 func SessionMiddleware(ttlSec int) func(http.Handler) http.Handler {
+	return SessionMiddlewareWithStore(NewRedisStore(ttlSec))
+}
+
+// SessionMiddlewareWithStore — SessionMiddleware с произвольным бэкендом хранения.
+// Изменённая сессия сохраняется перед записью заголовков ответа и ещё раз после
+// handler'а. Cookie-бэкенд не может сохранить изменения, сделанные после записи ответа.
+func SessionMiddlewareWithStore(store Store) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 
-			cookie, err := r.Cookie("session_id")
-			if err != nil || cookie.Value == "" {
+			sess, err := store.Load(ctxSession, r)
+			duration := time.Since(start).Seconds()
+			sessionDurationHist.Record(r.Context(), duration) // время загрузки сессии
+
+			switch {
+			case errors.Is(err, ErrNoSession):
 				sessionMissingCounter.Add(r.Context(), 1)
 				utils.JSON(w, http.StatusUnauthorized, map[string]string{
 					"error": "missing session_id",
 				})
 				return
-			}
-
-			sessionKey := "session:" + cookie.Value
-			res, err := sessionScript.Run(ctxSession, redisClientSession, []string{sessionKey}, ttlSec).Result()
-			duration := time.Since(start).Seconds()
-			sessionDurationHist.Record(r.Context(), duration) // время выполнения Lua скрипта
-
-			if err != nil {
-				next.ServeHTTP(w, r)
-				return
-			}
-
-			if res == nil {
+			case errors.Is(err, ErrSessionNotFound):
 				sessionNotFoundCounter.Add(r.Context(), 1)
 				utils.JSON(w, http.StatusUnauthorized, map[string]string{
 					"error": "session not found",
 				})
 				return
+			case errors.Is(err, ErrInvalidSession):
+				utils.JSON(w, http.StatusInternalServerError, map[string]string{
+					"error": "invalid session data",
+				})
+				return
+			case err != nil:
+				// fail-open: при недоступности хранилища пропускаем запрос без сессии
+				next.ServeHTTP(w, r)
+				return
 			}
 
 			sessionRenewedCounter.Add(r.Context(), 1) // сессия успешно продлена
-			next.ServeHTTP(w, r)
+
+			commit := func() {
+				// Флаг снимается до Save: Set, пришедший во время сохранения, снова пометит сессию
+				sess.mu.Lock()
+				dirty := sess.dirty
+				sess.dirty = false
+				sess.mu.Unlock()
+				if !dirty {
+					return
+				}
+				if err := store.Save(ctxSession, w, sess); err != nil {
+					sess.mu.Lock()
+					sess.dirty = true
+					sess.mu.Unlock()
+					return
+				}
+				sessionSavedCounter.Add(r.Context(), 1)
+			}
+
+			sw := &sessionWriter{ResponseWriter: w, commit: commit}
+			next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), contextKey{}, sess)))
+			commit()
 		})
 	}
 }
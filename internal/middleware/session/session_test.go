@@ -0,0 +1,271 @@
+package session
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+)
+
+func TestSessionMiddleware(t *testing.T) {
+	if err := InitRedisSession("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+
+	id, err := Create(ctxSession, 10)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer redisClientSession.Del(ctxSession, "session:"+id)
+
+	// Первый handler записывает данные и flash-сообщение, второй — читает их.
+	write := SessionMiddleware(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Set(r.Context(), "user", "alice")
+		AddFlash(r.Context(), "welcome")
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	var user interface{}
+	var flashes, flashesAgain []string
+	read := SessionMiddleware(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = Get(r.Context(), "user")
+		flashes = Flashes(r.Context())
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	readAgain := SessionMiddleware(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flashesAgain = Flashes(r.Context())
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+
+	for _, h := range []http.Handler{write, read, readAgain} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: id})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+	}
+
+	if user != "alice" {
+		t.Errorf("expected user alice, got %v", user)
+	}
+	if len(flashes) != 1 || flashes[0] != "welcome" {
+		t.Errorf("expected flash [welcome], got %v", flashes)
+	}
+	// Flash-сообщения показываются один раз
+	if len(flashesAgain) != 0 {
+		t.Errorf("expected flashes to be consumed, got %v", flashesAgain)
+	}
+
+	// Неизвестная сессия — 401
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session_id", Value: "unknown"})
+	w := httptest.NewRecorder()
+	read.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for unknown session, got %d", w.Code)
+	}
+
+	// Испорченные данные сессии — 500, а не запрос без сессии
+	redisClientSession.HSet(ctxSession, "session:"+id, "data", "{broken")
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session_id", Value: id})
+	w = httptest.NewRecorder()
+	read.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 for corrupt session data, got %d", w.Code)
+	}
+}
+
+func TestCookieStore(t *testing.T) {
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+
+	store, err := NewCookieStore(60, oldKey)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	// Создаём сессию и получаем зашифрованную cookie
+	w := httptest.NewRecorder()
+	if _, err := store.Create(ctxSession, w); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	handler := SessionMiddlewareWithStore(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Set(r.Context(), "user", "bob")
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected updated session cookie, got %d cookies", len(cookies))
+	}
+	cookie = cookies[0]
+
+	// После ротации новый store расшифровывает cookie старым ключом и перевыпускает её
+	rotated, err := NewCookieStore(60, newKey, oldKey)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	var user interface{}
+	read := SessionMiddlewareWithStore(rotated)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = Get(r.Context(), "user")
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	read.ServeHTTP(w, req)
+	if user != "bob" {
+		t.Errorf("expected user bob, got %v", user)
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Errorf("expected cookie to be re-encrypted with the new key")
+	}
+
+	// Подделанная cookie (изменён один байт шифротекста) отклоняется
+	raw, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		t.Fatalf("failed to decode cookie: %v", err)
+	}
+	raw[len(raw)-1] ^= 0x01
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: base64.RawURLEncoding.EncodeToString(raw)})
+	w = httptest.NewRecorder()
+	read.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for tampered cookie, got %d", w.Code)
+	}
+}
+
+func TestUserSessions(t *testing.T) {
+	if err := InitRedisSession("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+
+	userID := "test-user"
+	redisClientSession.Del(ctxSession, userSessionsKey(userID))
+
+	store := NewRedisStore(10)
+	store.MaxLifetimeSec = 1
+
+	// Две сессии пользователя, например с ноутбука и телефона
+	w := httptest.NewRecorder()
+	first, err := store.CreateForUser(ctxSession, w, userID)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	second, err := store.CreateForUser(ctxSession, httptest.NewRecorder(), userID)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	handler := SessionMiddlewareWithStore(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("User-Agent", "test-agent")
+	req.AddCookie(w.Result().Cookies()[0])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	// Индекс не живёт вечно: его TTL не меньше времени жизни сессий
+	if ttl := redisClientSession.TTL(ctxSession, userSessionsKey(userID)).Val(); ttl <= 0 {
+		t.Errorf("expected user sessions index to have TTL, got %v", ttl)
+	}
+
+	sessions, err := ListSessions(ctxSession, userID)
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+	for _, info := range sessions {
+		if info.ID == first.ID && (info.IP != "10.0.0.1" || info.UserAgent != "test-agent") {
+			t.Errorf("expected request metadata for first session, got %+v", info)
+		}
+	}
+
+	// Отзываем одну сессию, затем все остальные
+	if err := RevokeSession(ctxSession, userID, first.ID); err != nil {
+		t.Fatalf("failed to revoke session: %v", err)
+	}
+	if err := RevokeSession(ctxSession, "other-user", second.ID); err != ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound for foreign session, got %v", err)
+	}
+	if err := RevokeAllSessions(ctxSession, userID); err != nil {
+		t.Fatalf("failed to revoke sessions: %v", err)
+	}
+	sessions, _ = ListSessions(ctxSession, userID)
+	if len(sessions) != 0 {
+		t.Errorf("expected no sessions after revoke, got %d", len(sessions))
+	}
+
+	// Абсолютный таймаут: сессия истекает, даже если к ней обращаются
+	id, err := CreateForUser(ctxSession, 10, userID)
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: id})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 after absolute timeout, got %d", w.Code)
+	}
+}
+
+// racingStore — хранилище, в котором во время первого Save handler успевает изменить сессию.
+type racingStore struct {
+	sess  *Session
+	saves int
+}
+
+func (st *racingStore) Load(ctx context.Context, r *http.Request) (*Session, error) {
+	return st.sess, nil
+}
+
+func (st *racingStore) Save(ctx context.Context, w http.ResponseWriter, s *Session) error {
+	st.saves++
+	if st.saves == 1 {
+		s.Set("late", true)
+	}
+	return nil
+}
+
+func (st *racingStore) Create(ctx context.Context, w http.ResponseWriter) (*Session, error) {
+	return st.sess, nil
+}
+
+func TestSessionSetDuringSave(t *testing.T) {
+	store := &racingStore{sess: newSession("racing")}
+	handler := SessionMiddlewareWithStore(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Set(r.Context(), "user", "alice")
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// Изменение, сделанное во время первого сохранения, сохраняется после handler'а
+	if store.saves != 2 {
+		t.Errorf("expected change made during Save to be saved again, got %d saves", store.saves)
+	}
+}
@@ -0,0 +1,63 @@
+package stateupdate
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+)
+
+// ValueFunc извлекает из запроса ключ, ожидаемое или новое значение перехода.
+type ValueFunc func(r *http.Request) (string, error)
+
+// ErrMissingValue — в запросе нет значения, которое должен вернуть экстрактор.
+var ErrMissingValue = errors.New("missing value")
+
+// Const — экстрактор, всегда возвращающий v.
+func Const(v string) ValueFunc {
+	return func(r *http.Request) (string, error) {
+		return v, nil
+	}
+}
+
+// PathValue — параметр пути из шаблона маршрута ServeMux ({name}).
+func PathValue(name string) ValueFunc {
+	return func(r *http.Request) (string, error) {
+		return required(r.PathValue(name), "path value "+name)
+	}
+}
+
+// Query — параметр query.
+func Query(name string) ValueFunc {
+	return func(r *http.Request) (string, error) {
+		return required(r.URL.Query().Get(name), "query parameter "+name)
+	}
+}
+
+// Header — заголовок запроса.
+func Header(name string) ValueFunc {
+	return func(r *http.Request) (string, error) {
+		return required(r.Header.Get(name), "header "+name)
+	}
+}
+
+// JSONField — поле JSON-тела запроса, путь через точку ("order.state").
+// Строки берутся как есть, числа и bool — в текстовом виде. Тело после чтения
+// восстанавливается, поэтому несколько JSONField и handler читают его независимо.
+func JSONField(path string) ValueFunc {
+	return func(r *http.Request) (string, error) {
+		body, err := utils.ReadJSONBody(r)
+		if err != nil {
+			return "", err
+		}
+		return required(utils.JSONField(body, path), "JSON field "+path)
+	}
+}
+
+func required(value, what string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("%w: %s", ErrMissingValue, what)
+	}
+	return value, nil
+}
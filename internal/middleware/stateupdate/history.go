@@ -0,0 +1,232 @@
+package stateupdate
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/middleware/session"
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// defaultHistoryPage и maxHistoryPage — размер страницы HistoryHandler.
+	defaultHistoryPage = 50
+	maxHistoryPage     = 1000
+)
+
+// auditFuncs — Lua-функция журнала, общая для скриптов изменения состояния.
+// Скрипты принимают KEYS[2] — поток журнала ключа, и первые шесть аргументов:
+// ARGV[1] — "1", если журнал включён, ARGV[2] — principal, ARGV[3] — request ID,
+// ARGV[4] — время в мс, ARGV[5] — MAXLEN (0 — без ограничения), ARGV[6] — MINID в мс (0 — без ограничения).
+// audit(old, new) добавляет запись в журнал; old/new = false — значения не было (создание/удаление).
+const auditFuncs = `
+local function audit(old, new)
+    if ARGV[1] ~= "1" then
+        return
+    end
+    local fields = {"at", ARGV[4]}
+    if old then
+        table.insert(fields, "old")
+        table.insert(fields, old)
+    end
+    if new then
+        table.insert(fields, "new")
+        table.insert(fields, new)
+    end
+    if ARGV[2] ~= "" then
+        table.insert(fields, "principal")
+        table.insert(fields, ARGV[2])
+    end
+    if ARGV[3] ~= "" then
+        table.insert(fields, "request_id")
+        table.insert(fields, ARGV[3])
+    end
+    redis.call("XADD", KEYS[2], "*", unpack(fields))
+    if tonumber(ARGV[5]) > 0 then
+        redis.call("XTRIM", KEYS[2], "MAXLEN", ARGV[5])
+    end
+    if tonumber(ARGV[6]) > 0 then
+        redis.call("XTRIM", KEYS[2], "MINID", ARGV[6])
+    end
+end
+`
+
+// defaultHistoryMaxLen — сколько записей на ключ хранится, если не заданы ни MaxLen, ни MaxAge.
+const defaultHistoryMaxLen = 1000
+
+// HistoryOptions — журнал успешных изменений состояния. Журнал ключа — Redis Stream history:{<key>};
+// запись добавляется тем же Lua скриптом, что меняет состояние.
+type HistoryOptions struct {
+	// Enabled включает журнал (по умолчанию выключен).
+	Enabled bool
+	// MaxLen — хранить не больше стольких последних записей на ключ.
+	// Если не заданы ни MaxLen, ни MaxAge — defaultHistoryMaxLen.
+	MaxLen int64
+	// MaxAge — удалять записи старше (0 — ограничение только по MaxLen).
+	MaxAge time.Duration
+	// Principal — кто выполнил изменение. По умолчанию — владелец сессии (session.FromContext);
+	// без session.SessionMiddleware на маршруте principal будет пустым, и его нужно задать явно —
+	// из проверенной личности (например, auth.PrincipalFromContext), а не из заголовков запроса.
+	Principal func(r *http.Request) string
+	// RequestID — ID запроса. По умолчанию — заголовок X-Request-ID.
+	RequestID func(r *http.Request) string
+}
+
+// HistoryEntry — запись журнала.
+type HistoryEntry struct {
+	ID string `json:"id"`
+	// Old и New — значения до и после; nil — значения не было (создание или удаление).
+	Old       *string   `json:"old"`
+	New       *string   `json:"new"`
+	Principal string    `json:"principal,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// historyKey — поток журнала ключа: history:{<key>}. Ключи ресурсов приходят из запроса,
+// поэтому журнал живёт в отдельном пространстве имён: суффикс вроде ":history" клиент мог бы
+// занять своим ресурсом. Фигурные скобки — hash tag: в кластере журнал лежит в одном слоте
+// с ключом (если в самом ключе скобок нет).
+func historyKey(key string) string {
+	return "history:{" + key + "}"
+}
+
+// args — первые шесть аргументов скрипта для auditFuncs.
+func (h HistoryOptions) args(r *http.Request) []interface{} {
+	if !h.Enabled {
+		return []interface{}{"0", "", "", 0, 0, 0}
+	}
+	principal, requestID := "", r.Header.Get("X-Request-ID")
+	if h.Principal != nil {
+		principal = h.Principal(r)
+	} else if s := session.FromContext(r.Context()); s != nil {
+		principal = s.UserID
+	}
+	if h.RequestID != nil {
+		requestID = h.RequestID(r)
+	}
+	now := time.Now()
+	minID := int64(0)
+	if h.MaxAge > 0 {
+		minID = now.Add(-h.MaxAge).UnixMilli()
+	}
+	maxLen := h.MaxLen
+	if maxLen <= 0 && h.MaxAge <= 0 {
+		maxLen = defaultHistoryMaxLen
+	}
+	return []interface{}{"1", principal, requestID, now.UnixMilli(), maxLen, minID}
+}
+
+// History возвращает записи журнала ключа от новых к старым: не больше limit записей,
+// начиная с записи перед before (пусто — с последней). Второе значение — курсор
+// следующей страницы, пусто — записей больше нет.
+func History(ctx context.Context, key, before string, limit int) ([]HistoryEntry, string, error) {
+	end := "+"
+	if before != "" {
+		end = "(" + before
+	}
+	msgs, err := redisClientState.XRevRangeN(ctxState, historyKey(key), end, "-", int64(limit)+1).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+		next = msgs[limit-1].ID
+	}
+	entries := make([]HistoryEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		entries = append(entries, historyEntry(msg))
+	}
+	return entries, next, nil
+}
+
+func historyEntry(msg redis.XMessage) HistoryEntry {
+	e := HistoryEntry{ID: msg.ID}
+	if v, ok := msg.Values["old"].(string); ok {
+		e.Old = &v
+	}
+	if v, ok := msg.Values["new"].(string); ok {
+		e.New = &v
+	}
+	e.Principal, _ = msg.Values["principal"].(string)
+	e.RequestID, _ = msg.Values["request_id"].(string)
+	ms, err := strconv.ParseInt(stringValue(msg.Values["at"]), 10, 64)
+	if err != nil {
+		ms, _ = strconv.ParseInt(strings.SplitN(msg.ID, "-", 2)[0], 10, 64)
+	}
+	e.At = time.UnixMilli(ms).UTC()
+	return e
+}
+
+// validStreamID — похоже ли значение на ID записи потока ("1700000000000-0").
+func validStreamID(id string) bool {
+	ms, seq, _ := strings.Cut(id, "-")
+	if _, err := strconv.ParseUint(ms, 10, 64); err != nil {
+		return false
+	}
+	if _, err := strconv.ParseUint(seq, 10, 64); err != nil {
+		return false
+	}
+	return true
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// HistoryHandler — endpoint журнала ключа. Ключ строится так же, как в middleware
+// (opts.KeyPrefix + opts.Key). Параметры: limit (по умолчанию 50, не больше 1000)
+// и before — курсор из поля "next" предыдущей страницы. Записи — от новых к старым.
+func HistoryHandler(opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			utils.JSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if opts.Key == nil {
+			utils.JSON(w, http.StatusInternalServerError, map[string]string{"error": "no extractor for key"})
+			return
+		}
+		key, err := opts.Key(r)
+		if err != nil {
+			utils.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		key = opts.KeyPrefix + key
+
+		limit := defaultHistoryPage
+		if v := r.URL.Query().Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+				return
+			}
+			if limit > maxHistoryPage {
+				limit = maxHistoryPage
+			}
+		}
+
+		before := r.URL.Query().Get("before")
+		if before != "" && !validStreamID(before) {
+			utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid before cursor"})
+			return
+		}
+
+		entries, next, err := History(r.Context(), key, before, limit)
+		if err != nil {
+			utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to read history"})
+			return
+		}
+		resp := map[string]interface{}{"key": key, "entries": entries}
+		if next != "" {
+			resp["next"] = next
+		}
+		utils.JSON(w, http.StatusOK, resp)
+	})
+}
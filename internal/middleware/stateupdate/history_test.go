@@ -0,0 +1,95 @@
+package stateupdate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	if err := InitRedisState("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	key := "state:test:hist:1"
+	redisClientState.Del(ctxState, key, historyKey(key))
+	defer redisClientState.Del(ctxState, key, historyKey(key))
+	redisClientState.Set(ctxState, key, "s0", 0)
+
+	opts := Options{
+		KeyPrefix: "state:test:hist:",
+		Key:       PathValue("id"),
+		Expected:  JSONField("expected"),
+		Value:     JSONField("value"),
+		History: HistoryOptions{
+			Enabled:   true,
+			MaxLen:    3,
+			Principal: func(r *http.Request) string { return "alice" },
+		},
+	}
+	mux := http.NewServeMux()
+	mux.Handle("POST /items/{id}", StateUpdateMiddlewareWithOptions(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	mux.Handle("GET /items/{id}/history", HistoryHandler(opts))
+
+	// 1. Пять успешных переходов и один неудачный — в журнале три последних (MaxLen)
+	for i, tr := range []string{"s0:s1", "s1:s2", "s2:s3", "bad:s9", "s3:s4", "s4:s5"} {
+		parts := strings.Split(tr, ":")
+		req := httptest.NewRequest(http.MethodPost, "/items/1", strings.NewReader(`{"expected":"`+parts[0]+`","value":"`+parts[1]+`"}`))
+		req.Header.Set("X-Request-ID", "req-"+parts[1])
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if want := map[bool]int{true: http.StatusConflict, false: http.StatusOK}[i == 3]; w.Code != want {
+			t.Fatalf("transition %s: expected %d, got %d", tr, want, w.Code)
+		}
+	}
+	if n, _ := redisClientState.XLen(ctxState, historyKey(key)).Result(); n != 3 {
+		t.Fatalf("expected 3 history entries after trim, got %d", n)
+	}
+
+	// 2. Постраничное чтение: от новых к старым
+	page := func(query string) (entries []HistoryEntry, next string) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/items/1/history"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Entries []HistoryEntry `json:"entries"`
+			Next    string         `json:"next"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Entries, resp.Next
+	}
+	first, next := page("?limit=2")
+	if len(first) != 2 || next == "" || *first[0].Old != "s4" || *first[0].New != "s5" {
+		t.Fatalf("unexpected first page: %+v next=%q", first, next)
+	}
+	if first[0].Principal != "alice" || first[0].RequestID != "req-s5" || first[0].At.IsZero() {
+		t.Errorf("expected principal, request ID and time, got %+v", first[0])
+	}
+	second, next := page("?limit=2&before=" + next)
+	if len(second) != 1 || next != "" || *second[0].New != "s3" {
+		t.Errorf("unexpected second page: %+v next=%q", second, next)
+	}
+
+	// 3. Неверный курсор — 400
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/items/1/history?before=abc", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid cursor, got %d", w.Code)
+	}
+
+	// 4. Ресурс с id "1:history" — обычный ключ, журнал ресурса "1" он не задевает
+	defer redisClientState.Del(ctxState, key+":history", historyKey(key+":history"))
+	redisClientState.Set(ctxState, key+":history", "x0", 0)
+	req := httptest.NewRequest(http.MethodPost, "/items/1:history", strings.NewReader(`{"expected":"x0","value":"x1"}`))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for resource ending with :history, got %d", w.Code)
+	}
+	if n, _ := redisClientState.XLen(ctxState, historyKey(key)).Result(); n != 3 {
+		t.Errorf("expected history of %q to stay intact, got %d entries", key, n)
+	}
+}
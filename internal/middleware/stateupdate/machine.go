@@ -0,0 +1,355 @@
+package stateupdate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+	"gopkg.in/yaml.v3"
+)
+
+// AnyState в поле From правила означает "из любого состояния, кроме целевого".
+const AnyState = "*"
+
+var (
+	// KEYS[1] — ключ состояния, KEYS[2] — журнал. ARGV[1..6] — см. auditFuncs,
+	// ARGV[7] — состояние, для которого проверены guard'ы ("" — ключа нет),
+	// ARGV[8] — целевое состояние, ARGV[9..] — состояния, из которых в целевое разрешён переход.
+	// Возвращает {1, прежнее состояние} или {0, текущее состояние}, если оно изменилось
+	// или переход из него не разрешён.
+	transitionScript = redis.NewScript(auditFuncs + `
+local current = redis.call("GET", KEYS[1]) or ""
+if current ~= ARGV[7] then
+    return {0, current}
+end
+for i = 9, #ARGV do
+    if ARGV[i] == current then
+        redis.call("SET", KEYS[1], ARGV[8])
+        audit(current ~= "" and current, ARGV[8])
+        return {1, current}
+    end
+end
+return {0, current}
+`)
+)
+
+// Guard — дополнительное условие перехода (например, "заказ оплачен полностью").
+// Ошибка запрещает переход: 409 с её текстом. t.Expected — текущее состояние.
+type Guard func(r *http.Request, t Transition) error
+
+// TransitionEvent — применённый переход.
+type TransitionEvent struct {
+	Key string
+	// From — прежнее состояние; пусто, если ключа не было.
+	From string
+	To   string
+	At   time.Time
+}
+
+// TransitionHook вызывается после каждого применённого перехода, до handler'а.
+// Вызов синхронный: долгую работу хук должен уносить в фон сам.
+type TransitionHook func(ctx context.Context, e TransitionEvent)
+
+// StateList — список состояний; в YAML можно записать и одной строкой.
+type StateList []string
+
+// UnmarshalYAML принимает как "from: paid", так и "from: [created, paid]".
+func (l *StateList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = StateList{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// TransitionRule — разрешённые переходы из From в To.
+type TransitionRule struct {
+	From StateList `yaml:"from"`
+	To   string    `yaml:"to"`
+	// Guards — названия условий, зарегистрированных через Machine.Guard.
+	Guards []string `yaml:"guards"`
+}
+
+// MachineDefinition — описание конечного автомата, в коде или в YAML:
+//
+//	initial: created
+//	states: [created, paid, shipped, delivered, cancelled]
+//	transitions:
+//	  - {from: created, to: paid}
+//	  - {from: paid, to: shipped, guards: [in_stock]}
+//	  - {from: shipped, to: delivered}
+//	  - {from: "*", to: cancelled}
+type MachineDefinition struct {
+	// Initial — состояние, в которое ключ можно перевести, пока его нет.
+	Initial     string           `yaml:"initial"`
+	States      []string         `yaml:"states"`
+	Transitions []TransitionRule `yaml:"transitions"`
+}
+
+// Machine — конечный автомат состояний ключей. Guard и OnTransition
+// регистрируются до начала обработки запросов.
+type Machine struct {
+	initial string
+	states  []string
+	known   map[string]bool
+	// next — разрешённые переходы: из состояния в список целевых (в порядке States)
+	next   map[string][]string
+	guards map[[2]string][]string
+
+	guardFuncs map[string]Guard
+	hooks      []TransitionHook
+}
+
+// NewMachine проверяет описание и строит автомат.
+func NewMachine(def MachineDefinition) (*Machine, error) {
+	if len(def.States) == 0 {
+		return nil, errors.New("state machine has no states")
+	}
+	m := &Machine{
+		initial:    def.Initial,
+		states:     def.States,
+		known:      make(map[string]bool, len(def.States)),
+		next:       make(map[string][]string),
+		guards:     make(map[[2]string][]string),
+		guardFuncs: make(map[string]Guard),
+	}
+	for _, s := range def.States {
+		if s == "" || s == AnyState {
+			return nil, fmt.Errorf("invalid state name %q", s)
+		}
+		if m.known[s] {
+			return nil, fmt.Errorf("duplicate state %q", s)
+		}
+		m.known[s] = true
+	}
+	if !m.known[def.Initial] {
+		return nil, fmt.Errorf("initial state %q is not declared", def.Initial)
+	}
+
+	edges := make(map[[2]string]bool)
+	for _, rule := range def.Transitions {
+		if !m.known[rule.To] {
+			return nil, fmt.Errorf("transition to undeclared state %q", rule.To)
+		}
+		if len(rule.From) == 0 {
+			return nil, fmt.Errorf("transition to %q has no source states", rule.To)
+		}
+		for _, from := range rule.From {
+			sources := []string{from}
+			if from == AnyState {
+				sources = def.States
+			} else if !m.known[from] {
+				return nil, fmt.Errorf("transition from undeclared state %q", from)
+			}
+			for _, src := range sources {
+				if src == rule.To && from == AnyState {
+					continue
+				}
+				edge := [2]string{src, rule.To}
+				edges[edge] = true
+				m.guards[edge] = append(m.guards[edge], rule.Guards...)
+			}
+		}
+	}
+	for _, from := range def.States {
+		for _, to := range def.States {
+			if edges[[2]string{from, to}] {
+				m.next[from] = append(m.next[from], to)
+			}
+		}
+	}
+	return m, nil
+}
+
+// LoadMachine разбирает описание автомата из YAML (неизвестные поля — ошибка).
+func LoadMachine(data []byte) (*Machine, error) {
+	var def MachineDefinition
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&def); err != nil {
+		return nil, fmt.Errorf("invalid state machine definition: %w", err)
+	}
+	return NewMachine(def)
+}
+
+// LoadMachineFile читает описание автомата из YAML-файла.
+func LoadMachineFile(path string) (*Machine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadMachine(data)
+}
+
+// Guard регистрирует условие под именем, на которое ссылаются правила.
+func (m *Machine) Guard(name string, g Guard) *Machine {
+	m.guardFuncs[name] = g
+	return m
+}
+
+// OnTransition добавляет хук, вызываемый после каждого применённого перехода.
+func (m *Machine) OnTransition(h TransitionHook) *Machine {
+	m.hooks = append(m.hooks, h)
+	return m
+}
+
+// Allowed возвращает состояния, в которые можно перейти из from ("" — ключа ещё нет).
+func (m *Machine) Allowed(from string) []string {
+	if from == "" {
+		return []string{m.initial}
+	}
+	return append([]string(nil), m.next[from]...)
+}
+
+// Can — разрешён ли переход из from в to.
+func (m *Machine) Can(from, to string) bool {
+	for _, s := range m.Allowed(from) {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// sourcesOf — состояния, из которых разрешён переход в to ("" — создание ключа).
+func (m *Machine) sourcesOf(to string) []string {
+	var sources []string
+	if to == m.initial {
+		sources = append(sources, "")
+	}
+	for _, from := range m.states {
+		if m.Can(from, to) {
+			sources = append(sources, from)
+		}
+	}
+	return sources
+}
+
+// checkGuards проверяет, что все guard'ы из правил зарегистрированы.
+func (m *Machine) checkGuards() error {
+	for edge, names := range m.guards {
+		for _, name := range names {
+			if m.guardFuncs[name] == nil {
+				return fmt.Errorf("guard %q for transition %s -> %s is not registered", name, edge[0], edge[1])
+			}
+		}
+	}
+	return nil
+}
+
+// StateMachineMiddleware переводит ключ в состояние из запроса (opts.Value) по правилам автомата.
+// Переход проверяется по текущему состоянию, затем выполняются guard'ы, и одним Lua скриптом
+// состояние меняется, только если оно не изменилось за это время и переход разрешён.
+// Запрещённый переход — 409 с текущим состоянием и списком разрешённых ("allowed").
+// Если задан opts.Expected, текущее состояние должно ещё и совпасть с ним.
+//
+// Паникует, если правила ссылаются на незарегистрированный guard.
+func StateMachineMiddleware(m *Machine, opts Options) func(http.Handler) http.Handler {
+	if err := m.checkGuards(); err != nil {
+		panic(err)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, status, err := opts.transition(r, opts.Expected != nil)
+			if err == nil && !m.known[t.Value] {
+				status, err = http.StatusUnprocessableEntity, fmt.Errorf("unknown state %q", t.Value)
+			}
+			if err != nil {
+				failCounter.Add(r.Context(), 1)
+				utils.JSON(w, status, map[string]string{"error": err.Error()})
+				return
+			}
+
+			start := time.Now()
+			defer func() {
+				durationHist.Record(r.Context(), time.Since(start).Seconds())
+			}()
+
+			current, err := redisClientState.Get(ctxState, t.Key).Result()
+			if err != nil && err != redis.Nil {
+				failCounter.Add(r.Context(), 1)
+				utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to read state"})
+				return
+			}
+
+			if opts.Expected != nil && t.Expected != current {
+				writeTransitionConflict(w, r, m, t, current, "expected state did not match")
+				return
+			}
+			t.Expected = current
+			if !m.Can(current, t.Value) {
+				writeTransitionConflict(w, r, m, t, current, "transition not allowed")
+				return
+			}
+			for _, name := range m.guards[[2]string{current, t.Value}] {
+				if err := m.guardFuncs[name](r, t); err != nil {
+					writeTransitionConflict(w, r, m, t, current, err.Error())
+					return
+				}
+			}
+
+			applied, actual, err := applyTransition(r, opts.History, m, t)
+			if err != nil {
+				// Переход не записан — успех handler'а сообщать нельзя
+				failCounter.Add(r.Context(), 1)
+				utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to update state"})
+				return
+			}
+			if !applied {
+				writeTransitionConflict(w, r, m, t, actual, "state changed concurrently")
+				return
+			}
+
+			successCounter.Add(r.Context(), 1)
+			event := TransitionEvent{Key: t.Key, From: current, To: t.Value, At: time.Now()}
+			for _, h := range m.hooks {
+				h(r.Context(), event)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), transitionContextKey{}, t)))
+		})
+	}
+}
+
+// applyTransition атомарно переводит ключ из t.Expected в t.Value и пишет переход в журнал.
+// При отказе возвращает актуальное состояние.
+func applyTransition(r *http.Request, h HistoryOptions, m *Machine, t Transition) (bool, string, error) {
+	args := append(h.args(r), t.Expected, t.Value)
+	args = append(args, stringsToArgs(m.sourcesOf(t.Value))...)
+	res, err := transitionScript.Run(ctxState, redisClientState, []string{t.Key, historyKey(t.Key)}, args...).Result()
+	if err != nil {
+		return false, "", err
+	}
+	values, _ := res.([]interface{})
+	if len(values) != 2 {
+		return false, "", fmt.Errorf("unexpected transition result: %v", res)
+	}
+	ok, _ := values[0].(int64)
+	current, _ := values[1].(string)
+	return ok == 1, current, nil
+}
+
+func writeTransitionConflict(w http.ResponseWriter, r *http.Request, m *Machine, t Transition, current, reason string) {
+	failCounter.Add(r.Context(), 1)
+	var cur interface{}
+	if current != "" {
+		cur = current
+	}
+	utils.JSON(w, http.StatusConflict, map[string]interface{}{
+		"error":     reason,
+		"key":       t.Key,
+		"current":   cur,
+		"requested": t.Value,
+		"allowed":   m.Allowed(current),
+	})
+}
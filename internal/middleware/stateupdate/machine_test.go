@@ -0,0 +1,158 @@
+package stateupdate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+const orderMachineYAML = `
+initial: created
+states: [created, paid, shipped, delivered, cancelled]
+transitions:
+  - {from: created, to: paid}
+  - {from: paid, to: shipped, guards: [in_stock]}
+  - {from: shipped, to: delivered}
+  - {from: "*", to: cancelled}
+`
+
+func TestLoadMachine(t *testing.T) {
+	m, err := LoadMachine([]byte(orderMachineYAML))
+	if err != nil {
+		t.Fatalf("failed to load machine: %v", err)
+	}
+	if got := m.Allowed("created"); strings.Join(got, ",") != "paid,cancelled" {
+		t.Errorf("expected created -> paid,cancelled, got %v", got)
+	}
+	if m.Can("cancelled", "cancelled") || !m.Can("delivered", "cancelled") || m.Can("created", "shipped") {
+		t.Errorf("unexpected transitions: %v", m.next)
+	}
+	if got := m.Allowed(""); len(got) != 1 || got[0] != "created" {
+		t.Errorf("expected missing key -> created, got %v", got)
+	}
+
+	// Ошибки описания
+	for _, bad := range []string{
+		"initial: x\nstates: [a]\n",
+		"initial: a\nstates: [a]\ntransitions:\n  - {from: a, to: b}\n",
+		"initial: a\nstates: [a, a]\n",
+		"initial: a\nstates: [a]\nunknown: 1\n",
+	} {
+		if _, err := LoadMachine([]byte(bad)); err == nil {
+			t.Errorf("expected error for definition %q", bad)
+		}
+	}
+}
+
+func TestStateMachineMiddleware(t *testing.T) {
+	if err := InitRedisState("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	redisClientState.Del(ctxState, "state:test:sm:7")
+	defer redisClientState.Del(ctxState, "state:test:sm:7")
+
+	m, err := LoadMachine([]byte(orderMachineYAML))
+	if err != nil {
+		t.Fatalf("failed to load machine: %v", err)
+	}
+	inStock := false
+	// closed — клиент, с которым любой вызов Redis завершается ошибкой
+	client, closed := redisClientState, redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	closed.Close()
+	defer func() { redisClientState = client }()
+	failAfterGuard := false
+	var events []TransitionEvent
+	m.Guard("in_stock", func(r *http.Request, tr Transition) error {
+		if !inStock {
+			return errors.New("item is out of stock")
+		}
+		if failAfterGuard {
+			redisClientState = closed
+		}
+		return nil
+	}).OnTransition(func(ctx context.Context, e TransitionEvent) {
+		events = append(events, e)
+	})
+
+	mw := StateMachineMiddleware(m, Options{
+		KeyPrefix: "state:test:sm:",
+		Key:       PathValue("id"),
+		Value:     JSONField("state"),
+	})
+	mux := http.NewServeMux()
+	mux.Handle("POST /orders/{id}/state", mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.JSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})))
+	do := func(state string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/7/state", strings.NewReader(`{"state":"`+state+`"}`)))
+		resp := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	// 1. Ключа нет — разрешено только начальное состояние
+	if code, resp := do("paid"); code != http.StatusConflict || resp["current"] != nil {
+		t.Errorf("expected 409 with null current, got %d %v", code, resp)
+	}
+	for _, state := range []string{"created", "paid"} {
+		if code, resp := do(state); code != http.StatusOK {
+			t.Fatalf("expected transition to %s, got %d %v", state, code, resp)
+		}
+	}
+
+	// 2. Недопустимый переход — 409 со списком разрешённых
+	code, resp := do("delivered")
+	if allowed, _ := resp["allowed"].([]interface{}); code != http.StatusConflict || len(allowed) != 2 || allowed[0] != "shipped" {
+		t.Errorf("expected 409 with allowed [shipped cancelled], got %d %v", code, resp)
+	}
+
+	// 3. Guard запрещает переход, пока условие не выполнено
+	if code, resp := do("shipped"); code != http.StatusConflict || resp["error"] != "item is out of stock" {
+		t.Errorf("expected guard rejection, got %d %v", code, resp)
+	}
+	inStock = true
+	if code, _ := do("shipped"); code != http.StatusOK {
+		t.Errorf("expected transition to shipped, got %d", code)
+	}
+
+	// 4. Неизвестное состояние — 422
+	if code, _ := do("lost"); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for unknown state, got %d", code)
+	}
+
+	// 5. Хук получил все применённые переходы
+	if len(events) != 3 || events[0].From != "" || events[2].From != "paid" || events[2].To != "shipped" {
+		t.Errorf("unexpected transition events: %+v", events)
+	}
+	if v, _ := redisClientState.Get(ctxState, "state:test:sm:7").Result(); v != "shipped" {
+		t.Errorf("expected state shipped, got %q", v)
+	}
+
+	// 6. Ошибка Redis — 503, handler и хуки не вызываются: при чтении состояния...
+	redisClientState = closed
+	if code, resp := do("delivered"); code != http.StatusServiceUnavailable || resp["status"] != nil {
+		t.Errorf("expected 503 when state cannot be read, got %d %v", code, resp)
+	}
+	// ...и при записи перехода
+	redisClientState = client
+	redisClientState.Set(ctxState, "state:test:sm:7", "paid", 0)
+	failAfterGuard = true
+	if code, resp := do("shipped"); code != http.StatusServiceUnavailable || resp["status"] != nil {
+		t.Errorf("expected 503 when transition cannot be written, got %d %v", code, resp)
+	}
+	redisClientState = client
+	if len(events) != 3 {
+		t.Errorf("expected no events for failed transitions, got %+v", events)
+	}
+	if v, _ := redisClientState.Get(ctxState, "state:test:sm:7").Result(); v != "paid" {
+		t.Errorf("expected state to stay paid, got %q", v)
+	}
+}
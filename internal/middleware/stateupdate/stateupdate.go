@@ -2,9 +2,11 @@ package stateupdate
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-portfolio/http-middleware/internal/utils"
 	"github.com/go-redis/redis/v8"
@@ -21,13 +23,17 @@ var (
 	failCounter    metric.Int64Counter
 	durationHist   metric.Float64Histogram
 
-	stateUpdateScript = redis.NewScript(`
-if redis.call("GET", KEYS[1]) == ARGV[1] then
-    redis.call("SET", KEYS[1], ARGV[2])
-    return 1
-else
-    return 0
+	// KEYS[1] — ключ, KEYS[2] — журнал. ARGV[1..6] — см. auditFuncs,
+	// ARGV[7] — ожидаемое значение, ARGV[8] — новое.
+	// Возвращает {1} при успехе, иначе {0, текущее значение} ({0}, если ключа нет).
+	stateUpdateScript = redis.NewScript(auditFuncs + `
+local current = redis.call("GET", KEYS[1])
+if current == ARGV[7] then
+    redis.call("SET", KEYS[1], ARGV[8])
+    audit(current, ARGV[8])
+    return {1}
 end
+return {0, current}
 `)
 )
 
@@ -51,33 +57,161 @@ func InitRedisState(addr, password string, db int) error {
 	return nil
 }
 
-// StateUpdateMiddleware с метриками
+// defaultMaxValueSize — предел длины ожидаемого и нового значения по умолчанию.
+const defaultMaxValueSize = 64 << 10
+
+// maxKeyLength — предел длины ключа, извлечённого из запроса.
+const maxKeyLength = 200
+
+// Transition — переход состояния: ключ, ожидаемое и новое значение.
+type Transition struct {
+	Key      string
+	Expected string
+	Value    string
+}
+
+type transitionContextKey struct{}
+
+// TransitionFromContext возвращает переход, успешно применённый к текущему запросу.
+func TransitionFromContext(ctx context.Context) (Transition, bool) {
+	t, ok := ctx.Value(transitionContextKey{}).(Transition)
+	return t, ok
+}
+
+// Options — настройки StateUpdateMiddlewareWithOptions: откуда брать ключ и значения перехода.
+type Options struct {
+	// KeyPrefix добавляется к ключу, полученному из Key.
+	KeyPrefix string
+	// Key, Expected, Value — экстракторы ключа, ожидаемого и нового значения
+	// (Const, PathValue, Query, Header, JSONField или свои). Для StateMachineMiddleware
+	// Value — целевое состояние, а Expected необязателен.
+	Key      ValueFunc
+	Expected ValueFunc
+	Value    ValueFunc
+	// Validate — дополнительная проверка перехода; ошибка — 422.
+	Validate func(t Transition) error
+	// MaxValueSize — предел длины ожидаемого и нового значения в байтах (0 — 64 КБ).
+	MaxValueSize int
+	// History — журнал изменений (включается History.Enabled, см. HistoryHandler).
+	History HistoryOptions
+}
+
+func (opts Options) maxValueSize() int {
+	if opts.MaxValueSize > 0 {
+		return opts.MaxValueSize
+	}
+	return defaultMaxValueSize
+}
+
+// transition извлекает и проверяет переход. Ошибка извлечения — 400, проверки — 422.
+func (opts Options) transition(r *http.Request, requireExpected bool) (Transition, int, error) {
+	var t Transition
+	for _, f := range []struct {
+		extract ValueFunc
+		dst     *string
+		name    string
+	}{{opts.Key, &t.Key, "key"}, {opts.Expected, &t.Expected, "expected"}, {opts.Value, &t.Value, "value"}} {
+		if f.extract == nil {
+			// Ожидаемое значение необязательно для StateMachineMiddleware: там его знает машина
+			if f.name == "expected" && !requireExpected {
+				continue
+			}
+			return t, http.StatusInternalServerError, fmt.Errorf("no extractor for %s", f.name)
+		}
+		v, err := f.extract(r)
+		if err != nil {
+			return t, http.StatusBadRequest, err
+		}
+		*f.dst = v
+	}
+
+	if t.Key == "" || len(t.Key) > maxKeyLength {
+		return t, http.StatusUnprocessableEntity, fmt.Errorf("key must be 1..%d bytes", maxKeyLength)
+	}
+	t.Key = opts.KeyPrefix + t.Key
+	if len(t.Expected) > opts.maxValueSize() || len(t.Value) > opts.maxValueSize() {
+		return t, http.StatusUnprocessableEntity, fmt.Errorf("values must not exceed %d bytes", opts.maxValueSize())
+	}
+	if !utf8.ValidString(t.Expected) || !utf8.ValidString(t.Value) {
+		return t, http.StatusUnprocessableEntity, errors.New("values must be valid UTF-8")
+	}
+	if opts.Validate != nil {
+		if err := opts.Validate(t); err != nil {
+			return t, http.StatusUnprocessableEntity, err
+		}
+	}
+	return t, 0, nil
+}
+
+// StateUpdateMiddleware с метриками: переход key: expected -> newVal с фиксированными значениями.
 func StateUpdateMiddleware(key, expected, newVal string) func(http.Handler) http.Handler {
+	return StateUpdateMiddlewareWithOptions(Options{
+		Key:      Const(key),
+		Expected: Const(expected),
+		Value:    Const(newVal),
+	})
+}
+
+// StateUpdateMiddlewareWithOptions — compare-and-set, где ключ и значения берутся из запроса.
+// Если текущее значение не совпало с ожидаемым — 409 с текущим значением ("current",
+// null — ключа нет), чтобы клиент мог сверить состояние и повторить.
+func StateUpdateMiddlewareWithOptions(opts Options) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			start := time.Now()
+			t, status, err := opts.transition(r, true)
+			if err != nil {
+				failCounter.Add(r.Context(), 1)
+				utils.JSON(w, status, map[string]string{"error": err.Error()})
+				return
+			}
 
-			res, err := stateUpdateScript.Run(ctxState, redisClientState, []string{key}, expected, newVal).Result()
-			duration := time.Since(start).Seconds()
-			durationHist.Record(r.Context(), duration) // записываем время выполнения
+			start := time.Now()
+			ok, current, err := compareAndSet(r, opts.History, t)
+			durationHist.Record(r.Context(), time.Since(start).Seconds()) // записываем время выполнения
 
 			if err != nil {
+				// Запись не состоялась — успех handler'а сообщать нельзя
 				failCounter.Add(r.Context(), 1)
-				next.ServeHTTP(w, r)
+				utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to update state"})
 				return
 			}
 
-			success, ok := res.(int64)
-			if !ok || success == 0 {
+			if !ok {
 				failCounter.Add(r.Context(), 1)
-				utils.JSON(w, http.StatusConflict, map[string]string{
-					"error": "update failed, expected value did not match",
+				utils.JSON(w, http.StatusConflict, map[string]interface{}{
+					"error":    "update failed, expected value did not match",
+					"key":      t.Key,
+					"expected": t.Expected,
+					"current":  current,
 				})
 				return
 			}
 
 			successCounter.Add(r.Context(), 1)
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), transitionContextKey{}, t)))
 		})
 	}
 }
+
+// compareAndSet применяет переход и пишет его в журнал.
+// При несовпадении возвращает текущее значение (nil — ключа нет).
+func compareAndSet(r *http.Request, h HistoryOptions, t Transition) (bool, *string, error) {
+	args := append(h.args(r), t.Expected, t.Value)
+	res, err := stateUpdateScript.Run(ctxState, redisClientState, []string{t.Key, historyKey(t.Key)}, args...).Result()
+	if err != nil {
+		return false, nil, err
+	}
+	values, _ := res.([]interface{})
+	if len(values) == 0 {
+		return false, nil, fmt.Errorf("unexpected state update result: %v", res)
+	}
+	if ok, _ := values[0].(int64); ok == 1 {
+		return true, nil, nil
+	}
+	if len(values) > 1 {
+		if current, ok := values[1].(string); ok {
+			return false, &current, nil
+		}
+	}
+	return false, nil, nil
+}
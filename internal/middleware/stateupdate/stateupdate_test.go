@@ -0,0 +1,84 @@
+package stateupdate
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestStateUpdateFromRequest(t *testing.T) {
+	if err := InitRedisState("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	redisClientState.Set(ctxState, "state:test:order:42", "new", 0)
+	defer redisClientState.Del(ctxState, "state:test:order:42")
+
+	mw := StateUpdateMiddlewareWithOptions(Options{
+		KeyPrefix: "state:test:order:",
+		Key:       PathValue("id"),
+		Expected:  JSONField("expected"),
+		Value:     JSONField("value"),
+		Validate: func(tr Transition) error {
+			if tr.Value == "deleted" {
+				return errors.New("transition to deleted is not allowed")
+			}
+			return nil
+		},
+	})
+	mux := http.NewServeMux()
+	mux.Handle("POST /orders/{id}/state", mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr, _ := TransitionFromContext(r.Context())
+		utils.JSON(w, http.StatusOK, map[string]string{"state": tr.Value})
+	})))
+	do := func(body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/42/state", strings.NewReader(body)))
+		resp := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	// 1. Совпало ожидаемое значение — переход применён
+	if code, resp := do(`{"expected":"new","value":"paid"}`); code != http.StatusOK || resp["state"] != "paid" {
+		t.Fatalf("expected 200 with state paid, got %d %v", code, resp)
+	}
+
+	// 2. Устаревшее ожидание — 409 с текущим значением
+	code, resp := do(`{"expected":"new","value":"shipped"}`)
+	if code != http.StatusConflict || resp["current"] != "paid" {
+		t.Errorf("expected 409 with current paid, got %d %v", code, resp)
+	}
+
+	// 3. Нет поля — 400, проверка не прошла — 422
+	if code, _ := do(`{"value":"shipped"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for missing expected, got %d", code)
+	}
+	if code, _ := do(`{"expected":"paid","value":"deleted"}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for invalid transition, got %d", code)
+	}
+	if v, _ := redisClientState.Get(ctxState, "state:test:order:42").Result(); v != "paid" {
+		t.Errorf("expected state to stay paid, got %q", v)
+	}
+
+	// 4. Ключа нет — в ответе current: null
+	redisClientState.Del(ctxState, "state:test:order:42")
+	code, resp = do(`{"expected":"paid","value":"shipped"}`)
+	if current, ok := resp["current"]; code != http.StatusConflict || !ok || current != nil {
+		t.Errorf("expected 409 with null current, got %d %v", code, resp)
+	}
+
+	// 5. Redis недоступен — 503, handler не вызывается
+	client := redisClientState
+	redisClientState = redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	redisClientState.Close()
+	defer func() { redisClientState = client }()
+	if code, resp := do(`{"expected":"paid","value":"shipped"}`); code != http.StatusServiceUnavailable || resp["state"] != nil {
+		t.Errorf("expected 503 without calling handler, got %d %v", code, resp)
+	}
+}
@@ -0,0 +1,307 @@
+package stateupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+// defaultMaxBodySize — предел тела записи в версионируемом режиме.
+const defaultMaxBodySize = 1 << 20
+
+var (
+	// Версионируемый ресурс — HASH {value, version}. Удаление оставляет надгробие — HASH без value
+	// с увеличенной версией, чтобы пересозданный ресурс не повторил ETag удалённого.
+	// KEYS[1] — ресурс, KEYS[2] — журнал. ARGV[1..6] — см. auditFuncs,
+	// ARGV[7] — "set" или "del", ARGV[8] — новое значение,
+	// ARGV[9..] — допустимые версии из If-Match ("*" — любая существующая, "0" — ресурса нет).
+	// Возвращает {1, новая версия} (0 после удаления) или {0, текущая версия}, если ни одна
+	// версия не совпала; у отсутствующего или удалённого ресурса текущая версия — 0.
+	versionedUpdateScript = redis.NewScript(auditFuncs + `
+local current = tonumber(redis.call("HGET", KEYS[1], "version") or "0")
+local old = redis.call("HGET", KEYS[1], "value")
+local exists = old ~= false
+local matched = false
+for i = 9, #ARGV do
+    local v = ARGV[i]
+    if (v == "*" and exists) or (v == "0" and not exists) or (exists and tonumber(v) == current) then
+        matched = true
+        break
+    end
+end
+if not matched then
+    if exists then
+        return {0, current}
+    end
+    return {0, 0}
+end
+if ARGV[7] == "del" then
+    if exists then
+        redis.call("HSET", KEYS[1], "version", current + 1)
+        redis.call("HDEL", KEYS[1], "value")
+        audit(old, false)
+    end
+    return {1, 0}
+end
+redis.call("HSET", KEYS[1], "value", ARGV[8], "version", current + 1)
+audit(old, ARGV[8])
+return {1, current + 1}
+`)
+)
+
+// ErrPreconditionFailed — версия ресурса не совпала с If-Match.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Resource — версионируемый ресурс, прочитанный или записанный VersionedMiddleware.
+type Resource struct {
+	Key   string
+	Value string
+	// Version — номер версии; 0 — ресурса нет (или он удалён этим запросом).
+	Version int64
+}
+
+// ETag — сильный ETag версии ресурса.
+func (res Resource) ETag() string {
+	return formatETag(res.Version)
+}
+
+type resourceContextKey struct{}
+
+// ResourceFromContext возвращает ресурс текущего запроса VersionedMiddleware:
+// для чтения — текущее состояние, для записи — состояние после неё.
+func ResourceFromContext(ctx context.Context) (Resource, bool) {
+	res, ok := ctx.Value(resourceContextKey{}).(Resource)
+	return res, ok
+}
+
+// VersionedOptions — настройки VersionedMiddleware.
+type VersionedOptions struct {
+	// KeyPrefix — префикс ключей ресурсов: ключ — KeyPrefix + путь запроса.
+	KeyPrefix string
+	// KeyFunc строит ключ ресурса по запросу; если задан, KeyPrefix не используется.
+	KeyFunc func(r *http.Request) (string, error)
+	// MaxBodySize — предел тела записи в байтах (0 — 1 МБ).
+	MaxBodySize int64
+	// History — журнал изменений (включается History.Enabled).
+	History HistoryOptions
+}
+
+func (opts VersionedOptions) resourceKey(r *http.Request) (string, error) {
+	if opts.KeyFunc != nil {
+		return opts.KeyFunc(r)
+	}
+	return opts.KeyPrefix + r.URL.Path, nil
+}
+
+func (opts VersionedOptions) maxBodySize() int64 {
+	if opts.MaxBodySize > 0 {
+		return opts.MaxBodySize
+	}
+	return defaultMaxBodySize
+}
+
+// VersionedMiddleware — оптимистичная блокировка ресурсов по ETag/If-Match.
+// У каждого ключа есть номер версии. GET и HEAD отдают ETag текущей версии
+// (If-None-Match с ней же — 304). PUT, POST и PATCH записывают тело запроса как новое значение,
+// DELETE удаляет ресурс; запись требует If-Match (или If-None-Match: * для создания),
+// иначе 428. Сравнение версии и запись — один Lua скрипт; при несовпадении — 412 с ETag текущей версии.
+//
+// Handler получает ресурс через ResourceFromContext. При ошибке Redis чтение пропускается
+// без ресурса, а запись отклоняется с 503: без проверки версии писать нельзя.
+func VersionedMiddleware(opts VersionedOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			defer func() {
+				durationHist.Record(r.Context(), time.Since(start).Seconds())
+			}()
+
+			key, err := opts.resourceKey(r)
+			if err != nil {
+				utils.JSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				res, err := loadResource(key)
+				if err != nil {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if res.Version > 0 {
+					w.Header().Set("ETag", res.ETag())
+					if etagListMatches(r.Header.Get("If-None-Match"), res.Version) {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), resourceContextKey{}, res)))
+				return
+			}
+
+			versions, ok := preconditionVersions(r.Header)
+			if !ok {
+				failCounter.Add(r.Context(), 1)
+				utils.JSON(w, http.StatusPreconditionRequired, map[string]string{
+					"error": "If-Match header is required",
+				})
+				return
+			}
+
+			op, value := "set", ""
+			if r.Method == http.MethodDelete {
+				op = "del"
+			} else {
+				body, err := io.ReadAll(io.LimitReader(r.Body, opts.maxBodySize()+1))
+				if err != nil {
+					utils.JSON(w, http.StatusBadRequest, map[string]string{"error": "failed to read body"})
+					return
+				}
+				if int64(len(body)) > opts.maxBodySize() {
+					utils.JSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "payload too large"})
+					return
+				}
+				value = string(body)
+			}
+
+			version, err := updateVersioned(r, opts.History, key, op, value, versions)
+			if errors.Is(err, ErrPreconditionFailed) {
+				failCounter.Add(r.Context(), 1)
+				if version > 0 {
+					w.Header().Set("ETag", formatETag(version))
+				}
+				utils.JSON(w, http.StatusPreconditionFailed, map[string]interface{}{
+					"error":   "resource version does not match If-Match",
+					"version": version,
+				})
+				return
+			}
+			if err != nil {
+				failCounter.Add(r.Context(), 1)
+				utils.JSON(w, http.StatusServiceUnavailable, map[string]string{"error": "failed to update resource"})
+				return
+			}
+
+			successCounter.Add(r.Context(), 1)
+			res := Resource{Key: key, Version: version}
+			if op == "set" {
+				res.Value = value
+				w.Header().Set("ETag", res.ETag())
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), resourceContextKey{}, res)))
+		})
+	}
+}
+
+// loadResource читает значение и версию ресурса. Надгробие удалённого ресурса
+// читается как отсутствующий ресурс (версия 0).
+func loadResource(key string) (Resource, error) {
+	vals, err := redisClientState.HMGet(ctxState, key, "value", "version").Result()
+	if err != nil {
+		return Resource{}, err
+	}
+	res := Resource{Key: key}
+	value, ok := vals[0].(string)
+	if !ok {
+		return res, nil
+	}
+	res.Value = value
+	if v, ok := vals[1].(string); ok {
+		res.Version, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return res, nil
+}
+
+// updateVersioned атомарно сверяет версию и записывает (op "set") или удаляет (op "del") ресурс,
+// добавляя изменение в журнал. Возвращает новую версию или ErrPreconditionFailed с текущей версией.
+func updateVersioned(r *http.Request, h HistoryOptions, key, op, value string, versions []string) (int64, error) {
+	args := append(h.args(r), op, value)
+	args = append(args, stringsToArgs(versions)...)
+	res, err := versionedUpdateScript.Run(ctxState, redisClientState, []string{key, historyKey(key)}, args...).Result()
+	if err != nil {
+		return 0, err
+	}
+	values, _ := res.([]interface{})
+	if len(values) != 2 {
+		return 0, fmt.Errorf("unexpected versioned update result: %v", res)
+	}
+	ok, _ := values[0].(int64)
+	version, _ := values[1].(int64)
+	if ok == 0 {
+		return version, ErrPreconditionFailed
+	}
+	return version, nil
+}
+
+// preconditionVersions разбирает If-Match (или If-None-Match: * для создания) в список версий
+// для скрипта. false — заголовка нет. Слабые и чужие ETag не совпадают ни с одной версией.
+func preconditionVersions(h http.Header) ([]string, bool) {
+	ifMatch := strings.TrimSpace(h.Get("If-Match"))
+	if ifMatch == "" {
+		if strings.TrimSpace(h.Get("If-None-Match")) == "*" {
+			return []string{"0"}, true
+		}
+		return nil, false
+	}
+	if ifMatch == "*" {
+		return []string{"*"}, true
+	}
+	var versions []string
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if v, ok := parseETag(tag); ok {
+			versions = append(versions, strconv.FormatInt(v, 10))
+		}
+	}
+	// Ни одного разборчивого ETag — версия -1 не совпадёт никогда
+	if len(versions) == 0 {
+		versions = []string{"-1"}
+	}
+	return versions, true
+}
+
+// etagListMatches — совпадает ли версия с одним из ETag в If-None-Match (слабое сравнение).
+func etagListMatches(header string, version int64) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if v, ok := parseETag(tag); ok && v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func formatETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseETag разбирает сильный ETag вида "N".
+func parseETag(tag string) (int64, bool) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) < 3 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+func stringsToArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
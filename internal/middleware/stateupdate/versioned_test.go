@@ -0,0 +1,86 @@
+package stateupdate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-portfolio/http-middleware/internal/utils"
+)
+
+func TestVersionedMiddleware(t *testing.T) {
+	if err := InitRedisState("localhost:6379", "", 1); err != nil {
+		t.Fatalf("failed to init redis: %v", err)
+	}
+	opts := VersionedOptions{KeyPrefix: "state:test"}
+	redisClientState.Del(ctxState, "state:test/items/1")
+
+	handler := VersionedMiddleware(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, _ := ResourceFromContext(r.Context())
+		utils.JSON(w, http.StatusOK, map[string]interface{}{"value": res.Value, "version": res.Version})
+	}))
+	do := func(method string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/items/1", strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// 1. Запись без If-Match — 428
+	if w := do(http.MethodPut, "a", nil); w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("expected 428, got %d", w.Code)
+	}
+
+	// 2. Создание с If-None-Match: * — версия 1
+	w := do(http.MethodPut, "a", map[string]string{"If-None-Match": "*"})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"1"` {
+		t.Fatalf("expected 200 with ETag \"1\", got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	// 3. GET отдаёт ETag, If-None-Match с ним — 304
+	if w := do(http.MethodGet, "", nil); w.Header().Get("ETag") != `"1"` || !strings.Contains(w.Body.String(), `"value":"a"`) {
+		t.Errorf("expected ETag \"1\" and value a, got %q %s", w.Header().Get("ETag"), w.Body.String())
+	}
+	if w := do(http.MethodGet, "", map[string]string{"If-None-Match": `"1"`}); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", w.Code)
+	}
+
+	// 4. Запись с актуальной версией — версия растёт; со старой — 412 с текущим ETag
+	if w := do(http.MethodPut, "b", map[string]string{"If-Match": `"1"`}); w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("expected 200 with ETag \"2\", got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	w = do(http.MethodPut, "c", map[string]string{"If-Match": `"1"`})
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != `"2"` {
+		t.Errorf("expected 412 with ETag \"2\", got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	if v, _ := redisClientState.HGet(ctxState, "state:test/items/1", "value").Result(); v != "b" {
+		t.Errorf("expected value b after failed write, got %q", v)
+	}
+
+	// 5. Повторное создание — 412; удаление по версии
+	if w := do(http.MethodPut, "d", map[string]string{"If-None-Match": "*"}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 for create over existing resource, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "", map[string]string{"If-Match": `"2"`}); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for delete, got %d", w.Code)
+	}
+	if w := do(http.MethodGet, "", nil); w.Header().Get("ETag") != "" || !strings.Contains(w.Body.String(), `"version":0`) {
+		t.Errorf("expected deleted resource to be absent, got %q %s", w.Header().Get("ETag"), w.Body.String())
+	}
+
+	// 6. Пересоздание продолжает счёт версий: ETag удалённого ресурса больше не совпадает
+	w = do(http.MethodPut, "e", map[string]string{"If-None-Match": "*"})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"4"` {
+		t.Fatalf("expected recreate with ETag \"4\", got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	if w := do(http.MethodPut, "stale", map[string]string{"If-Match": `"2"`}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 for stale If-Match after recreate, got %d", w.Code)
+	}
+	if v, _ := redisClientState.HGet(ctxState, "state:test/items/1", "value").Result(); v != "e" {
+		t.Errorf("expected value e after stale write, got %q", v)
+	}
+}
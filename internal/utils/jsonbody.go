@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// MaxJSONBodySize — сколько байт тела запроса читает ReadJSONBody.
+const MaxJSONBodySize = 1 << 20
+
+// ReadJSONBody читает JSON-объект из тела запроса (не больше MaxJSONBodySize байт)
+// и восстанавливает r.Body, чтобы middleware и handler могли прочитать его снова.
+// Пустое тело — пустой объект. Числа остаются json.Number.
+func ReadJSONBody(r *http.Request) (map[string]interface{}, error) {
+	if r.Body == nil {
+		return map[string]interface{}{}, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, MaxJSONBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	// Непрочитанный остаток тела (сверх MaxJSONBodySize) тоже возвращаем handler'у
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+
+	body := map[string]interface{}{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return body, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return body, nil
+}
+
+// JSONField достаёт поле объекта по пути через точку ("order.id").
+// Строки, числа и bool приводятся к строке, остальное (и отсутствующее поле) — пустая строка.
+func JSONField(body map[string]interface{}, path string) string {
+	var cur interface{} = body
+	for _, name := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		cur = m[name]
+	}
+	switch v := cur.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}